@@ -12,6 +12,8 @@ require (
 	go.opentelemetry.io/otel/log v0.9.0
 	go.opentelemetry.io/otel/sdk v1.33.0
 	go.opentelemetry.io/otel/sdk/log v0.9.0
+	go.opentelemetry.io/otel/trace v1.33.0
+	priorityfetcher v0.0.0
 )
 
 require (
@@ -22,7 +24,6 @@ require (
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.24.0 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
 	go.opentelemetry.io/otel/metric v1.33.0 // indirect
-	go.opentelemetry.io/otel/trace v1.33.0 // indirect
 	go.opentelemetry.io/proto/otlp v1.4.0 // indirect
 	golang.org/x/net v0.32.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
@@ -38,3 +39,5 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	go.opentelemetry.io/contrib/bridges/otelslog v0.8.0
 )
+
+replace priorityfetcher => ../priorityfetcher
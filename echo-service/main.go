@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"priorityfetcher"
+	"priorityfetcher/shutdown"
+	"sync"
+	"syscall"
 
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
@@ -33,13 +38,42 @@ import (
 
 type EchoResponse struct {
 	ExecutionId int                    `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	Outputs     map[string]interface{} `json:"outputs"`
+	DispatchId  string                 `json:"dispatchId"`
 }
 
 type TaskRequest struct {
 	ExecutionId int                    `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	TaskName    string                 `json:"taskName"`
 	Inputs      map[string]interface{} `json:"inputs"`
+	DispatchId  string                 `json:"dispatchId"` // Echoed in the response so the scheduler can drop duplicates
+}
+
+// TaskError is the error envelope the scheduler expects in the error output, it fills the attempt
+type TaskError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+	Worker    string      `json:"worker"`
+}
+
+func (t *TaskRequest) ToError(code string, msg string, retryable bool) EchoResponse {
+	return EchoResponse{
+		ExecutionId: t.ExecutionId,
+		StepName:    t.StepName,
+		DispatchId:  t.DispatchId,
+		Outputs: map[string]interface{}{
+			"error": TaskError{
+				Code:      code,
+				Message:   msg,
+				Retryable: retryable,
+				Worker:    serviceName,
+			},
+		},
+	}
 }
 
 var (
@@ -101,15 +135,15 @@ func initTracer() func(context.Context) error {
 		log.Printf("Could not set resources: %s", err)
 	}
 
-	otel.SetTracerProvider(
-		sdktrace.NewTracerProvider(
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter),
-			sdktrace.WithResource(resources),
-		),
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resources),
 	)
+	otel.SetTracerProvider(tracerProvider)
 
-	return exporter.Shutdown
+	// Flushes the spans of the batcher before shutting down the exporter
+	return tracerProvider.Shutdown
 }
 
 func initLogger() (context.Context, *setupLog.LoggerProvider) {
@@ -152,10 +186,7 @@ func main() {
 	}()
 	logger := otelslog.NewLogger("scheduler-init")
 
-	err := initTracer()
-	if err != nil {
-		logger.Info("Error initiating tracer", err)
-	}
+	cleanup := initTracer()
 
 	HostPort := os.Getenv("HOST_PORT")
 
@@ -168,12 +199,9 @@ func main() {
 	}
 
 	brokers := []string{os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")}
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:        brokers,
-		GroupID:        "native",
-		Topic:          os.Getenv("INPUT_TOPIC"),
-		CommitInterval: time.Second,
-	})
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	fetcher := priorityfetcher.New(stopCtx, brokers, "native", os.Getenv("INPUT_TOPIC"), priorityfetcher.PoolSize())
 
 	writer := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:  brokers,
@@ -182,9 +210,15 @@ func main() {
 	})
 
 	log.Print("Listening on topic: " + os.Getenv("INPUT_TOPIC"))
+	handlers := sync.WaitGroup{}
+	fetching := make(chan struct{})
 	go func() {
+		defer close(fetching)
 		for {
-			msg, err := reader.FetchMessage(context.Background())
+			msg, reader, err := fetcher.FetchMessage(stopCtx)
+			if stopCtx.Err() != nil {
+				return
+			}
 			if err != nil {
 				logger.Error("Error reading message:", err)
 			} else {
@@ -192,10 +226,14 @@ func main() {
 				err := json.Unmarshal(msg.Value, &request)
 				if err != nil {
 					logger.Error("Error unmarshaling message:", err)
+					fetcher.Done()
 					continue
 				}
 				ctx, span := CreateOrGetSpan("echo-service", msg.Headers)
+				handlers.Add(1)
 				go func() {
+					defer handlers.Done()
+					defer fetcher.Done() // Make room for the next message
 					defer span.End() // Close span
 					defer func() {
 						err := reader.CommitMessages(context.Background(), msg)
@@ -211,19 +249,14 @@ func main() {
 						var echoResponse EchoResponse
 						if !ok {
 							span.RecordError(fmt.Errorf("property msg not found in echo request"))
-							echoResponse = EchoResponse{
-								ExecutionId: request.ExecutionId,
-								Outputs: map[string]interface{}{
-									"error": map[string]string{
-										"msg": "No msg property in inputs",
-									},
-								},
-							}
+							echoResponse = request.ToError("invalid_input", "No msg property in inputs", false)
 						} else {
 							msg := fmt.Sprintf("%v", requestMessage)
 							span.SetAttributes(attribute.String("task.response", msg))
 							echoResponse = EchoResponse{
 								ExecutionId: request.ExecutionId,
+								StepName:    request.StepName,
+								DispatchId:  request.DispatchId,
 								Outputs: map[string]interface{}{
 									"msg": msg,
 								},
@@ -243,14 +276,7 @@ func main() {
 						}
 					} else {
 						span.RecordError(fmt.Errorf("unknown task name: %s", request.TaskName))
-						finalMsg, err := json.Marshal(EchoResponse{
-							ExecutionId: request.ExecutionId,
-							Outputs: map[string]interface{}{
-								"error": map[string]string{
-									"msg": "Invalid task",
-								},
-							},
-						})
+						finalMsg, err := json.Marshal(request.ToError("invalid_task", "Invalid task", false))
 						if err != nil {
 							span.RecordError(fmt.Errorf("error marshaling final response: %v", err))
 							logger.Error("Error marshaling final response: %v", err)
@@ -272,8 +298,37 @@ func main() {
 		io.WriteString(w, "This is my website!\n")
 	})
 
-	errServer := http.ListenAndServe(":8080", nil)
-	if errServer != nil {
-		log.Printf("Error binding to port %s", HostPort)
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		errServer := server.ListenAndServe()
+		if errServer != nil && !errors.Is(errServer, http.ErrServerClosed) {
+			log.Printf("Error binding to port %s", HostPort)
+			stop()
+		}
+	}()
+
+	<-stopCtx.Done()
+	log.Print("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdown.Timeout())
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	<-fetching
+	if !shutdown.WaitFor(shutdownCtx, &handlers) {
+		log.Print("Timed out waiting for the tasks being handled")
+	}
+	err = fetcher.Close()
+	if err != nil {
+		log.Printf("Error closing readers: %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		log.Printf("Error closing writer: %v", err)
+	}
+	err = cleanup(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down tracer: %v", err)
 	}
 }
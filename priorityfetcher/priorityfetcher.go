@@ -0,0 +1,141 @@
+// Package priorityfetcher fetches the input topics of the workers by priority,
+// the scheduler publishes the steps of each priority to their own topic and takes its own messages the same way
+package priorityfetcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// Priorities of the input topics from the highest to the lowest, the normal priority uses the input topic itself
+var Priorities = []string{"high", "normal", "low"}
+
+// Topic returns the input topic of the given priority
+func Topic(topic string, priority string) string {
+	if priority == "normal" {
+		return topic
+	}
+	return topic + "-" + priority
+}
+
+// PoolSize is how many messages a consumer handles at a time, configured with CONSUMER_POOL_SIZE
+func PoolSize() int {
+	size, err := strconv.Atoi(os.Getenv("CONSUMER_POOL_SIZE"))
+	if err != nil || size <= 0 {
+		return 16
+	}
+	return size
+}
+
+// fetchedMessage is a message along with the reader it has to be committed on
+type fetchedMessage struct {
+	msg    kafka.Message
+	reader *kafka.Reader
+	err    error
+}
+
+// Fetcher fetches the messages of the input topics of every priority,
+// a message is only taken when the topics of higher priorities have none waiting.
+// At most poolSize messages are handled at a time, no message is taken while the pool is full
+type Fetcher struct {
+	fetched []chan fetchedMessage
+	readers []*kafka.Reader
+	pool    chan struct{}
+}
+
+// New starts fetching the input topics until the context is done, poolSize messages are handled at a time
+func New(ctx context.Context, brokers []string, groupID string, topic string, poolSize int) *Fetcher {
+	fetcher := &Fetcher{
+		fetched: make([]chan fetchedMessage, len(Priorities)),
+		pool:    make(chan struct{}, max(poolSize, 1)),
+	}
+	for i, priority := range Priorities {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        brokers,
+			GroupID:        groupID,
+			Topic:          Topic(topic, priority),
+			CommitInterval: time.Second,
+		})
+		fetcher.readers = append(fetcher.readers, reader)
+		fetcher.fetched[i] = make(chan fetchedMessage)
+		go func(messages chan<- fetchedMessage) {
+			for {
+				msg, err := reader.FetchMessage(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case messages <- fetchedMessage{msg, reader, err}:
+				case <-ctx.Done():
+					// Never committed, it is fetched again once the service restarts
+					return
+				}
+			}
+		}(fetcher.fetched[i])
+	}
+	return fetcher
+}
+
+// FetchMessage waits for room in the pool and returns the message of the highest priority that is waiting,
+// or the first one to arrive when none is, along with the reader to commit it on.
+// Done has to be called once the message is handled, the room is given back right away when an error is returned.
+// Returns the error of the context once it is done
+func (f *Fetcher) FetchMessage(ctx context.Context) (kafka.Message, *kafka.Reader, error) {
+	select {
+	case f.pool <- struct{}{}:
+	case <-ctx.Done():
+		return kafka.Message{}, nil, ctx.Err()
+	}
+	_, fetched, ok := Next(ctx, f.fetched)
+	if !ok {
+		f.Done()
+		return kafka.Message{}, nil, ctx.Err()
+	}
+	if fetched.err != nil {
+		f.Done()
+	}
+	return fetched.msg, fetched.reader, fetched.err
+}
+
+// Done gives back the room in the pool of a fetched message once it is handled
+func (f *Fetcher) Done() {
+	<-f.pool
+}
+
+// Next takes the value of the highest priority channel that has one waiting, or the first one to arrive when none has.
+// Returns the index of the channel it was taken from, or false if the context is done before a value arrives
+func Next[T any](ctx context.Context, channels []chan T) (int, T, bool) {
+	for i, values := range channels {
+		select {
+		case value := <-values:
+			return i, value, true
+		default:
+		}
+	}
+	cases := make([]reflect.SelectCase, len(channels)+1)
+	for i, values := range channels {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(values)}
+	}
+	cases[len(channels)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	i, value, _ := reflect.Select(cases)
+	if i == len(channels) {
+		var zero T
+		return 0, zero, false
+	}
+	return i, value.Interface().(T), true
+}
+
+// Close closes the readers, flushing the commits of the handled messages
+func (f *Fetcher) Close() error {
+	errs := make([]error, 0)
+	for _, reader := range f.readers {
+		errs = append(errs, reader.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package priorityfetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func TestTopic(t *testing.T) {
+	tests := []struct {
+		priority string
+		want     string
+	}{
+		{priority: "high", want: "echo-input-high"},
+		{priority: "normal", want: "echo-input"},
+		{priority: "low", want: "echo-input-low"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.priority, func(t *testing.T) {
+			if got := Topic("echo-input", tt.priority); got != tt.want {
+				t.Errorf("Topic() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	channels := []chan string{make(chan string, 1), make(chan string, 1), make(chan string, 1)}
+	channels[2] <- "low"
+	channels[1] <- "normal"
+
+	// The highest priority that has a value waiting is taken first
+	want := []struct {
+		index int
+		value string
+	}{{1, "normal"}, {2, "low"}}
+	for _, w := range want {
+		i, value, _ := Next(context.Background(), channels)
+		if i != w.index || value != w.value {
+			t.Errorf("Next() = %d %s, want %d %s", i, value, w.index, w.value)
+		}
+	}
+
+	// Without values waiting it takes the first one to arrive
+	go func() {
+		channels[2] <- "late"
+	}()
+	if i, value, ok := Next(context.Background(), channels); !ok || i != 2 || value != "late" {
+		t.Errorf("Next() = %d %s, want 2 late", i, value)
+	}
+
+	// It gives up once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, ok := Next(ctx, channels); ok {
+		t.Errorf("Next() = true, want false once the context is done")
+	}
+}
+
+func TestFetcher_FetchMessage(t *testing.T) {
+	fetcher := &Fetcher{pool: make(chan struct{}, 1)}
+	for range Priorities {
+		fetcher.fetched = append(fetcher.fetched, make(chan fetchedMessage, 1))
+	}
+	fetcher.fetched[2] <- fetchedMessage{msg: kafka.Message{Value: []byte("low")}}
+	fetcher.fetched[0] <- fetchedMessage{msg: kafka.Message{Value: []byte("high")}}
+
+	msg, _, err := fetcher.FetchMessage(context.Background())
+	if err != nil || string(msg.Value) != "high" {
+		t.Fatalf("FetchMessage() = %s %v, want high", msg.Value, err)
+	}
+
+	// The low message waits while the pool is full, so a later high one is taken before it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := fetcher.FetchMessage(ctx); err == nil {
+		t.Fatalf("FetchMessage() = nil, want the error of the context while the pool is full")
+	}
+	fetcher.fetched[0] <- fetchedMessage{msg: kafka.Message{Value: []byte("later high")}}
+	fetcher.Done()
+	for _, want := range []string{"later high", "low"} {
+		msg, _, err := fetcher.FetchMessage(context.Background())
+		if err != nil || string(msg.Value) != want {
+			t.Errorf("FetchMessage() = %s %v, want %s", msg.Value, err, want)
+		}
+		fetcher.Done()
+	}
+}
@@ -0,0 +1,35 @@
+// Package shutdown holds what the scheduler and the workers share to stop gracefully
+package shutdown
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timeout is how long a service waits for the messages being handled once it is asked to stop,
+// configured with SHUTDOWN_TIMEOUT_SECONDS
+func Timeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return 25 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// WaitFor waits for the group until the context is done, returns false if it did not finish in time
+func WaitFor(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,33 @@
+package shutdown
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if WaitFor(ctx, &wg) {
+		t.Errorf("WaitFor() = true, want false while the group is running")
+	}
+	wg.Done()
+	if !WaitFor(context.Background(), &wg) {
+		t.Errorf("WaitFor() = false, want true once the group is done")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "")
+	if got := Timeout(); got != 25*time.Second {
+		t.Errorf("Timeout() = %s, want 25s", got)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "3")
+	if got := Timeout(); got != 3*time.Second {
+		t.Errorf("Timeout() = %s, want 3s", got)
+	}
+}
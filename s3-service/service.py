@@ -1,6 +1,7 @@
 import json
 from typing import List, Optional, Tuple
 import boto3
+from botocore.exceptions import ClientError
 import os, sys, threading
 from confluent_kafka import Consumer, KafkaError, Producer
 
@@ -51,7 +52,9 @@ app = Flask(__name__)
 """
 {
     "executionId": 123,
-    "taskName": "download|upload",
+    "stepName": "download-step",
+    "dispatchId": "",
+    "taskName": "download|upload|delete",
     "inputs": {
         "file_path": "path/to/file",
         "bucket_name": "bucket-name",
@@ -71,6 +74,28 @@ OUTPUT_TOPIC = os.getenv("OUTPUT_TOPIC")
 SERVICE_NAME = os.getenv("SERVICE_NAME")
 FILES_BASE_PATH = os.getenv("FILES_BASE_PATH", "/data")
 
+# S3 error codes of requests that fail the same way when retried
+NON_RETRYABLE_S3_ERRORS = {"NoSuchBucket", "NoSuchKey", "404", "AccessDenied", "403", "InvalidAccessKeyId", "SignatureDoesNotMatch", "InvalidBucketName"}
+
+def task_error(code, message, retryable, details=None):
+    """Builds the error envelope the scheduler expects in the error output, it fills the attempt."""
+    error = {
+        "code": code,
+        "message": message,
+        "retryable": retryable,
+        "worker": SERVICE_NAME,
+    }
+    if details:
+        error["details"] = details
+    return error
+
+def s3_error(message, e):
+    """Builds the error envelope of a failed S3 operation, the S3 error code goes in the details."""
+    if isinstance(e, ClientError):
+        s3_code = e.response.get("Error", {}).get("Code", "")
+        return task_error("s3_error", message, s3_code not in NON_RETRYABLE_S3_ERRORS, details={"s3_code": s3_code})
+    return task_error("execution_failed", message, True)
+
 class S3Service():
 
     def __init__(self, producer=None, consumer=None, input_topic=INPUT_TOPIC, output_topic=OUTPUT_TOPIC):
@@ -104,8 +129,9 @@ class S3Service():
             aws_session_token=session_token,
         ).client('s3')
 
-    def write_to_kafka(self, execution_id, status, span, path=None, error=None):
-        """Writes a result message to Kafka."""
+    def write_to_kafka(self, execution_id, status, span, path=None, error=None, step_name=None, dispatch_id=None):
+        """Writes a result message to Kafka, the error envelope goes under the error output so the scheduler fails the step.
+        The dispatch is echoed so the scheduler drops responses of previous attempts."""
         topic = self.output_topic
         body = {
             "status": status
@@ -113,9 +139,11 @@ class S3Service():
         if path:
             body["path"] = path
         if error:
-            body["error_msg"] = error
+            body = {"error": error}
         message = json.dumps({
             "executionId": execution_id,
+            "stepName": step_name,
+            "dispatchId": dispatch_id,
             "outputs": body
         }).encode("utf-8")
         try:
@@ -125,33 +153,45 @@ class S3Service():
         except Exception as e:
             logger.info(f"Error writing to Kafka: {e}")
 
-    def download_from_s3(self, execution_id, s3_client, bucket_name, s3_key, file_path, span):
+    def download_from_s3(self, execution_id, s3_client, bucket_name, s3_key, file_path, span, step_name=None, dispatch_id=None):
         """Downloads a file from S3 to the local filesystem."""
         try:
             logger.info(f"Downloading from S3: bucket={bucket_name}, key={s3_key} to {file_path}")
             s3_client.download_file(bucket_name, s3_key, file_path)
             logger.info("Download successful!")
-            self.write_to_kafka(execution_id, "success", span, path=file_path)
+            self.write_to_kafka(execution_id, "success", span, path=file_path, step_name=step_name, dispatch_id=dispatch_id)
         except Exception as e:
             error_msg = f"Error downloading from S3: {e}"
             logger.error(error_msg)
-            self.write_to_kafka(execution_id, "error", span, error=error_msg)
+            self.write_to_kafka(execution_id, "error", span, error=s3_error(error_msg, e), step_name=step_name, dispatch_id=dispatch_id)
 
-    def upload_to_s3(self, execution_id, s3_client, bucket_name, s3_key, file_path, span):
+    def upload_to_s3(self, execution_id, s3_client, bucket_name, s3_key, file_path, span, step_name=None, dispatch_id=None):
         """Uploads a local file to S3."""
         try:
             if not os.path.isfile(file_path):
                 logger.error(f"File does not exist: {file_path}")
-                self.write_to_kafka(execution_id, "error", span, error=f"File does not exist: {file_path}")
+                self.write_to_kafka(execution_id, "error", span, error=task_error("invalid_input", f"File does not exist: {file_path}", False), step_name=step_name, dispatch_id=dispatch_id)
                 return
             logger.info(f"Uploading to S3: {file_path} to bucket={bucket_name}, key={s3_key}")
             s3_client.upload_file(file_path, bucket_name, s3_key)
             logger.info("Upload successful!")
-            self.write_to_kafka(execution_id, "success", span, path=f"s3://{bucket_name}/{s3_key}")
+            self.write_to_kafka(execution_id, "success", span, path=f"s3://{bucket_name}/{s3_key}", step_name=step_name, dispatch_id=dispatch_id)
         except Exception as e:
             error_msg = f"Error uploading to S3: {e}"
             logger.error(error_msg)
-            self.write_to_kafka(execution_id, "error", span, error=error_msg)
+            self.write_to_kafka(execution_id, "error", span, error=s3_error(error_msg, e), step_name=step_name, dispatch_id=dispatch_id)
+
+    def delete_from_s3(self, execution_id, s3_client, bucket_name, s3_key, span, step_name=None, dispatch_id=None):
+        """Deletes an object from S3, used to compensate an upload."""
+        try:
+            logger.info(f"Deleting from S3: bucket={bucket_name}, key={s3_key}")
+            s3_client.delete_object(Bucket=bucket_name, Key=s3_key)
+            logger.info("Delete successful!")
+            self.write_to_kafka(execution_id, "success", span, path=f"s3://{bucket_name}/{s3_key}", step_name=step_name, dispatch_id=dispatch_id)
+        except Exception as e:
+            error_msg = f"Error deleting from S3: {e}"
+            logger.error(error_msg)
+            self.write_to_kafka(execution_id, "error", span, error=s3_error(error_msg, e), step_name=step_name, dispatch_id=dispatch_id)
 
     def extract_ctx(self, kafka_message):
         headers: Optional[List[Tuple[str, bytes]]] = kafka_message.headers()
@@ -168,11 +208,16 @@ class S3Service():
     def process_message(self, message):
         ctx = self.extract_ctx(message)
         with tracer.start_as_current_span("process_message", context=ctx) as span:
+            execution_id = None
+            step_name = None
+            dispatch_id = None
             try:
                 msg_str = message.value().decode("utf-8")
                 data = json.loads(msg_str)
                 span.set_attribute("data", msg_str)
                 execution_id = data.get("executionId")
+                step_name = data.get("stepName")
+                dispatch_id = data.get("dispatchId")
                 task = data.get("taskName")
                 inputs = data.get("inputs", None)
                 if inputs:
@@ -190,14 +235,14 @@ class S3Service():
                     exc_msg = "Invalid message: missing required fields"
                     span.record_exception(Exception(exc_msg))
                     logger.error(exc_msg)
-                    self.write_to_kafka(execution_id, "error", span, error=exc_msg)
+                    self.write_to_kafka(execution_id, "error", span, error=task_error("invalid_input", exc_msg, False), step_name=step_name, dispatch_id=dispatch_id)
                     return
                 
-                if task.lower() not in ["download", "upload"]:
+                if task.lower() not in ["download", "upload", "delete"]:
                     exc_msg = f"Unsupported task: {task}"
                     span.record_exception(Exception(exc_msg))
                     logger.error(exc_msg)
-                    self.write_to_kafka(execution_id, "error", span, error=exc_msg)
+                    self.write_to_kafka(execution_id, "error", span, error=task_error("invalid_task", exc_msg, False), step_name=step_name, dispatch_id=dispatch_id)
                     return
 
                 # Create S3 client
@@ -205,20 +250,22 @@ class S3Service():
 
                 # Perform operation
                 if task.lower() == "download":
-                    self.download_from_s3(execution_id, s3_client, bucket_name, s3_key, file_path, span)
+                    self.download_from_s3(execution_id, s3_client, bucket_name, s3_key, file_path, span, step_name=step_name, dispatch_id=dispatch_id)
                 elif task.lower() == "upload":
-                    self.upload_to_s3(execution_id, s3_client, bucket_name, s3_key, file_path, span)
+                    self.upload_to_s3(execution_id, s3_client, bucket_name, s3_key, file_path, span, step_name=step_name, dispatch_id=dispatch_id)
+                elif task.lower() == "delete":
+                    self.delete_from_s3(execution_id, s3_client, bucket_name, s3_key, span, step_name=step_name, dispatch_id=dispatch_id)
 
             except json.JSONDecodeError:
                 exc_msg = "Invalid message format: Not a valid JSON"
                 logger.error(exc_msg)
                 if execution_id:
-                    self.write_to_kafka(execution_id, "error", span, error="Invalid message format: Not a valid JSON")
+                    self.write_to_kafka(execution_id, "error", span, error=task_error("invalid_input", exc_msg, False), step_name=step_name, dispatch_id=dispatch_id)
             except Exception as e:
                 exc_msg = f"Error processing message: {e}"
                 logger.error(exc_msg)
                 if execution_id:
-                    self.write_to_kafka(execution_id, "error", span, error=exc_msg)
+                    self.write_to_kafka(execution_id, "error", span, error=task_error("execution_failed", exc_msg, True), step_name=step_name, dispatch_id=dispatch_id)
 
 
     def consume_kafka_messages(self):
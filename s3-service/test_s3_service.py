@@ -1,6 +1,8 @@
+import json
 import unittest
-from unittest.mock import patch, MagicMock
-from service import S3Service
+from unittest.mock import patch, MagicMock, ANY
+from botocore.exceptions import ClientError
+from service import S3Service, s3_error, task_error
 
 INPUT_TOPIC = 'input_topic'
 OUTPUT_TOPIC = 'output_topic'
@@ -33,17 +35,25 @@ class TestS3Service(unittest.TestCase):
         mock_session_instance.client.assert_called_once_with('s3')
         self.assertEqual(s3_client, mock_client)
 
-    @patch('service.json.dumps')
-    def test_write_to_kafka(self, mock_json_dumps):
-        self.service.write_to_kafka('execution_id', 'status', 'path', 'error')
+    def test_write_to_kafka(self):
+        error = task_error('invalid_input', 'File does not exist: file_path', False)
+        self.service.write_to_kafka('execution_id', 'error', None, error=error, step_name='upload')
 
-        mock_json_dumps.assert_called_once()
-        self.mock_producer.produce.assert_called_once()
-        self.mock_producer.produce.assert_called_once_with(
-            topic=OUTPUT_TOPIC,
-            message=mock_json_dumps.return_value.encode('utf-8')
-        )
+        self.mock_producer.produce.assert_called_once_with(topic=OUTPUT_TOPIC, value=ANY, headers=ANY)
+        message = json.loads(self.mock_producer.produce.call_args.kwargs['value'])
+        self.assertEqual(message['outputs'], {'error': error})
         self.mock_producer.flush.assert_called_once()
+
+    def test_s3_error(self):
+        not_found = ClientError({'Error': {'Code': 'NoSuchKey', 'Message': 'Not Found'}}, 'GetObject')
+        throttled = ClientError({'Error': {'Code': 'SlowDown', 'Message': 'Slow Down'}}, 'PutObject')
+
+        error = s3_error('Error downloading from S3', not_found)
+        self.assertEqual(error['code'], 's3_error')
+        self.assertFalse(error['retryable'])
+        self.assertEqual(error['details'], {'s3_code': 'NoSuchKey'})
+        self.assertTrue(s3_error('Error uploading to S3', throttled)['retryable'])
+        self.assertEqual(s3_error('Error uploading to S3', Exception('timeout'))['code'], 'execution_failed')
     
     @patch('service.boto3.Session')
     def test_download_from_s3(self, mock_boto_session):
@@ -76,6 +86,29 @@ class TestS3Service(unittest.TestCase):
 
         mock_client.upload_file.assert_not_called()
 
+
+    @patch('service.boto3.Session')
+    def test_delete_from_s3(self, mock_boto_session):
+        mock_client = mock_boto_session.return_value.client.return_value
+        with patch.object(self.service, 'write_to_kafka') as mock_write_to_kafka:
+            self.service.delete_from_s3('execution_id', mock_client, 'bucket_name', 's3_key', None, dispatch_id='dispatch')
+
+        mock_client.delete_object.assert_called_once_with(Bucket='bucket_name', Key='s3_key')
+        mock_write_to_kafka.assert_called_with('execution_id', 'success', None, path='s3://bucket_name/s3_key', step_name=None, dispatch_id='dispatch')
+    
+    def test_delete_from_s3_error(self):
+        # A failed compensation has to fail the step, the error goes under the error output
+        mock_client = MagicMock()
+        mock_client.delete_object.side_effect = Exception('Access Denied')
+        self.service.delete_from_s3('execution_id', mock_client, 'bucket_name', 's3_key', None, step_name='undo-upload', dispatch_id='dispatch')
+
+        self.mock_producer.produce.assert_called_once()
+        message = json.loads(self.mock_producer.produce.call_args.kwargs['value'])
+        self.assertEqual(message['stepName'], 'undo-upload')
+        self.assertEqual(message['dispatchId'], 'dispatch')
+        self.assertNotIn('status', message['outputs'])
+        self.assertEqual(message['outputs']['error']['message'], 'Error deleting from S3: Access Denied')
+        self.assertEqual(message['outputs']['error']['code'], 'execution_failed')
     
     def test_process_message(self):
         mock_message = MagicMock()
@@ -99,11 +132,11 @@ class TestS3Service(unittest.TestCase):
 
         mock_download.assert_not_called()
         mock_upload.assert_not_called()
-        mock_write_to_kafka.assert_called_with('123', 'error', error='Invalid message: missing required fields')
+        mock_write_to_kafka.assert_called_with('123', 'error', ANY, error=task_error('invalid_input', 'Invalid message: missing required fields', False), step_name=None, dispatch_id=None)
 
     def test_process_message_invalid_task(self):
         mock_message = MagicMock()
-        mock_message.value.return_value = b'{"executionId": "123", "taskName": "invalid_task", "inputs": {"file_path": "path/to/file", "bucket_name": "bucket-name", "s3_key": "path/in/bucket", "aws_access_key": "access-key", "aws_secret_key": "secret-key", "aws_region": "region"}}'
+        mock_message.value.return_value = b'{"executionId": "123", "dispatchId": "dispatch", "taskName": "invalid_task", "inputs": {"file_path": "path/to/file", "bucket_name": "bucket-name", "s3_key": "path/in/bucket", "aws_access_key": "access-key", "aws_secret_key": "secret-key", "aws_region": "region"}}'
 
         with patch.object(self.service, 'download_from_s3') as mock_download, \
              patch.object(self.service, 'upload_to_s3') as mock_upload, \
@@ -112,7 +145,7 @@ class TestS3Service(unittest.TestCase):
 
         mock_download.assert_not_called()
         mock_upload.assert_not_called()
-        mock_write_to_kafka.assert_called_with('123', 'error', error='Unsupported task: invalid_task')
+        mock_write_to_kafka.assert_called_with('123', 'error', ANY, error=task_error('invalid_task', 'Unsupported task: invalid_task', False), step_name=None, dispatch_id='dispatch')
     
 if __name__ == '__main__':
     unittest.main()
\ No newline at end of file
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"scheduler/repository"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runCompensations dispatches the next compensation of a failed execution.
+// Once there are none left the execution continues with its failure and finally steps,
+// ending compensated if any compensation ran or failed otherwise
+func (h *Handler) runCompensations(ctx context.Context, span trace.Span, state *repository.State) {
+	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	next := execution.NextCompensation()
+	if next == nil {
+		if state.Status == repository.COMPENSATING {
+			state.Outcome = repository.COMPENSATED
+		}
+		h.continueWithPhases(ctx, span, state, repository.ON_FAILURE, repository.FINALLY)
+		return
+	}
+
+	log.Printf("Compensating step %s of execution %d\n", next.Compensates, state.ExecutionID)
+	span.AddEvent("Compensation", trace.WithAttributes(
+		attribute.Int("ExecutionId", int(state.ExecutionID)),
+		attribute.String("Step", next.Compensates),
+	))
+	// The execution has to be compensating before the step is handled
+	state.Phase = repository.COMPENSATION
+	state.Status = repository.COMPENSATING
+	h.executionRepository.UpdateState(context.Background(), state)
+	err := h.dispatchStep(ctx, span, state, next)
+	if err != nil {
+		h.failStep(ctx, span, state, state.GetStepState(next.Name), fmt.Sprintf("Failed to enqueue step %s: %s", next.Name, err))
+	}
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"scheduler/repository"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// concurrencyLimits returns the limits a step of the service of the execution is subject to, by key:
+// the maximum concurrency of the service and the limit of the concurrency key of the execution
+func concurrencyLimits(state *repository.State, service repository.Service) map[string]uint {
+	limits := make(map[string]uint)
+	if service.MaxConcurrency > 0 {
+		limits["service:"+service.Name] = service.MaxConcurrency
+	}
+	if state.ConcurrencyKey != "" && state.ConcurrencyLimit > 0 {
+		limits["key:"+state.ConcurrencyKey] = state.ConcurrencyLimit
+	}
+	return limits
+}
+
+// acquireConcurrency returns whether the step can run, otherwise the step stays pending in the queue of the key
+// that reached its limit until a step holding it finishes
+func (h *Handler) acquireConcurrency(
+	ctx context.Context,
+	span trace.Span,
+	state *repository.State,
+	stepState *repository.StepState,
+	service repository.Service,
+	message []byte,
+) bool {
+	limits := concurrencyLimits(state, service)
+	if len(limits) == 0 {
+		return true
+	}
+	full, err := h.executionRepository.AcquireConcurrency(ctx, stepState.ID, limits)
+	if err != nil {
+		span.RecordError(err)
+		return false
+	}
+	if full == "" {
+		return true
+	}
+	log.Printf("Queueing step %s of execution %d, %s reached its limit of %d\n", stepState.Name, state.ExecutionID, full, limits[full])
+	span.AddEvent("QueuedStep", trace.WithAttributes(attribute.String("Key", full)))
+	err = h.executionRepository.QueueStep(ctx, &repository.QueuedStep{
+		Key:         full,
+		ExecutionID: state.ExecutionID,
+		StepName:    stepState.Name,
+		Priority:    state.Priority,
+		Message:     string(message),
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+	return false
+}
+
+// releaseConcurrency releases the leases of a step that stopped executing,
+// the step that has been waiting the longest for each of their keys is enqueued again
+func (h *Handler) releaseConcurrency(ctx context.Context, span trace.Span, stepState *repository.StepState) {
+	for _, key := range h.executionRepository.ReleaseConcurrency(ctx, stepState.ID) {
+		for {
+			queued := h.executionRepository.PopQueuedStep(ctx, key)
+			if queued == nil {
+				break
+			}
+			// Steps that stopped waiting, like the ones of paused executions, leave the lease to the next one
+			state := h.executionRepository.GetStateByExecutionID(ctx, queued.ExecutionID)
+			queuedState := state.GetStepState(queued.StepName)
+			if !state.IsActive() || queuedState == nil || queuedState.Status != repository.PENDING {
+				continue
+			}
+			log.Printf("Releasing step %s of execution %d from the queue of %s\n", queued.StepName, queued.ExecutionID, key)
+			span.AddEvent("ReleasedStep", trace.WithAttributes(
+				attribute.Int("ExecutionId", int(queued.ExecutionID)),
+				attribute.String("Step", queued.StepName),
+			))
+			err := h.enqueue(ctx, "", queued.Priority, []byte(queued.Message))
+			if err != nil {
+				span.RecordError(err)
+			}
+			break
+		}
+	}
+}
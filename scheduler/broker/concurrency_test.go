@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"reflect"
+	"scheduler/repository"
+	"testing"
+)
+
+func TestConcurrencyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   *repository.State
+		service repository.Service
+		want    map[string]uint
+	}{
+		{name: "No limits", state: &repository.State{}, service: repository.Service{Name: "echo_service"}, want: map[string]uint{}},
+		{
+			name:    "Service limit",
+			state:   &repository.State{},
+			service: repository.Service{Name: "ubuntu_service", MaxConcurrency: 20},
+			want:    map[string]uint{"service:ubuntu_service": 20},
+		},
+		{
+			name:    "Both limits",
+			state:   &repository.State{ConcurrencyKey: "nightly", ConcurrencyLimit: 1},
+			service: repository.Service{Name: "ubuntu_service", MaxConcurrency: 20},
+			want:    map[string]uint{"service:ubuntu_service": 20, "key:nightly": 1},
+		},
+		{
+			name:    "Key without limit",
+			state:   &repository.State{ConcurrencyKey: "nightly"},
+			service: repository.Service{Name: "echo_service"},
+			want:    map[string]uint{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := concurrencyLimits(tt.state, tt.service); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("concurrencyLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// condition of an if step, either a comparison or the and/or composition of other conditions
+type condition struct {
+	LeftValue  interface{} `json:"leftValue"`
+	Operator   string      `json:"operator"`
+	RightValue interface{} `json:"rightValue"`
+	And        []condition `json:"and"`
+	Or         []condition `json:"or"`
+}
+
+// jsonBytes returns the JSON of an input, inputs that are strings are expected to hold JSON already
+func jsonBytes(value interface{}) ([]byte, error) {
+	if str, ok := value.(string); ok {
+		return []byte(str), nil
+	}
+	return json.Marshal(value)
+}
+
+// parseConditions parses the conditions of an and/or input, they come as a list or as JSON
+func parseConditions(value interface{}) ([]condition, error) {
+	bytes, err := jsonBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	conditions := make([]condition, 0)
+	err = json.Unmarshal(bytes, &conditions)
+	if err != nil {
+		return nil, fmt.Errorf("conditions are not a JSON array: %s", bytes)
+	}
+	return conditions, nil
+}
+
+// evaluate returns whether the condition holds, and conditions stop at the first false one and or conditions at the first true one
+func (c condition) evaluate() (bool, error) {
+	if c.And != nil {
+		for _, sub := range c.And {
+			result, err := sub.evaluate()
+			if err != nil || !result {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if c.Or != nil {
+		for _, sub := range c.Or {
+			result, err := sub.evaluate()
+			if err != nil || result {
+				return result, err
+			}
+		}
+		return false, nil
+	}
+	return compareValues(c.LeftValue, c.Operator, c.RightValue)
+}
+
+// compareValues applies the operator to the values. Numbers stored as strings are compared as numbers,
+// and JSON arrays and objects stored as strings as the values they hold
+func compareValues(left interface{}, operator string, right interface{}) (bool, error) {
+	switch operator {
+	case "==":
+		return valuesEqual(left, right), nil
+	case "!=":
+		return !valuesEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		order, err := orderValues(left, right)
+		if err != nil {
+			return false, err
+		}
+		switch operator {
+		case "<":
+			return order < 0, nil
+		case "<=":
+			return order <= 0, nil
+		case ">":
+			return order > 0, nil
+		default:
+			return order >= 0, nil
+		}
+	case "contains":
+		return containsValue(left, right), nil
+	case "in":
+		return containsValue(right, left), nil
+	case "startsWith":
+		return strings.HasPrefix(stringValue(left), stringValue(right)), nil
+	case "matches":
+		matcher, err := regexp.Compile(stringValue(right))
+		if err != nil {
+			return false, fmt.Errorf("%s is not a valid regular expression", stringValue(right))
+		}
+		return matcher.MatchString(stringValue(left)), nil
+	case "isEmpty":
+		return isEmpty(left), nil
+	}
+	return false, fmt.Errorf("%s is not a valid operator", operator)
+}
+
+// valuesEqual compares numbers as numbers and the rest of the values by their text
+func valuesEqual(left interface{}, right interface{}) bool {
+	leftNumber, leftOk := numberValue(left)
+	rightNumber, rightOk := numberValue(right)
+	if leftOk && rightOk {
+		return leftNumber == rightNumber
+	}
+	return stringValue(left) == stringValue(right)
+}
+
+// orderValues compares two numbers, or two texts if either isn't a number
+func orderValues(left interface{}, right interface{}) (int, error) {
+	leftNumber, leftOk := numberValue(left)
+	rightNumber, rightOk := numberValue(right)
+	if leftOk && rightOk {
+		switch {
+		case leftNumber < rightNumber:
+			return -1, nil
+		case leftNumber > rightNumber:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	_, leftString := left.(string)
+	_, rightString := right.(string)
+	if !leftString || !rightString {
+		return 0, fmt.Errorf("can't order %v and %v", left, right)
+	}
+	return strings.Compare(left.(string), right.(string)), nil
+}
+
+// containsValue returns whether an array holds the value, an object has it as key or a text has it as substring
+func containsValue(container interface{}, value interface{}) bool {
+	switch v := jsonValue(container).(type) {
+	case []interface{}:
+		for _, element := range v {
+			if valuesEqual(element, value) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		_, ok := v[stringValue(value)]
+		return ok
+	default:
+		return strings.Contains(stringValue(v), stringValue(value))
+	}
+}
+
+// isEmpty returns whether the value is missing, an empty text, array or object
+func isEmpty(value interface{}) bool {
+	switch v := jsonValue(value).(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	case string:
+		return strings.TrimSpace(v) == ""
+	}
+	return false
+}
+
+// switchCase of a switch step, the step continues with next when the value matches,
+// compared with == unless the case has an operator
+type switchCase struct {
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value"`
+	Next     string      `json:"next"`
+}
+
+// parseCases parses the cases of a switch step, they come as a list or as JSON
+func parseCases(value interface{}) ([]switchCase, error) {
+	bytes, err := jsonBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	cases := make([]switchCase, 0)
+	err = json.Unmarshal(bytes, &cases)
+	if err != nil {
+		return nil, fmt.Errorf("cases are not a JSON array: %s", bytes)
+	}
+	for i, c := range cases {
+		if c.Next == "" {
+			return nil, fmt.Errorf("case %d has no next step", i)
+		}
+	}
+	return cases, nil
+}
+
+// matchCase returns the index of the first case that matches the value, -1 if none does
+func matchCase(value interface{}, cases []switchCase) (int, error) {
+	for i, c := range cases {
+		operator := c.Operator
+		if operator == "" {
+			operator = "=="
+		}
+		matches, err := compareValues(value, operator, c.Value)
+		if err != nil {
+			return -1, fmt.Errorf("case %d: %s", i, err)
+		}
+		if matches {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
@@ -4,6 +4,7 @@ import (
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"net"
 	"os"
+	"scheduler/repository"
 	"strconv"
 	"time"
 
@@ -18,10 +19,14 @@ func GetExecutionReader() *kafka.Reader {
 	return GetReader([]string{bootstrapServers}, topic, "submissions")
 }
 
-func GetStepReader() *kafka.Reader {
+// GetStepReaders returns the readers of the steps topics, from the highest priority to the lowest
+func GetStepReaders() []*kafka.Reader {
 	bootstrapServers := os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")
-	topic := GetStepKafkaTopic()
-	return GetReader([]string{bootstrapServers}, topic, "steps")
+	readers := make([]*kafka.Reader, len(repository.Priorities))
+	for i, priority := range repository.Priorities {
+		readers[i] = GetReader([]string{bootstrapServers}, PriorityTopic(GetStepKafkaTopic(), priority), "steps")
+	}
+	return readers
 }
 
 func GetReader(bootstrapServers []string, topic string, groupid string) *kafka.Reader {
@@ -58,6 +63,23 @@ func GetStepKafkaTopic() string {
 	return os.Getenv("STEPS_TOPIC")
 }
 
+// ServiceInputTopic returns the input topic of the service for the given priority,
+// services that aren't prioritized receive every priority on their input topic
+func ServiceInputTopic(service repository.Service, priority string) string {
+	if !service.Prioritized {
+		return service.InputTopic
+	}
+	return PriorityTopic(service.InputTopic, priority)
+}
+
+// PriorityTopic returns the topic of the given priority, the normal priority uses the topic itself
+func PriorityTopic(topic string, priority string) string {
+	if priority == repository.NORMAL_PRIORITY {
+		return topic
+	}
+	return topic + "-" + priority
+}
+
 func Initialize(serviceTopics []string) {
 
 	bootstrapServers := os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")
@@ -97,11 +119,13 @@ func Initialize(serviceTopics []string) {
 			NumPartitions:     3,
 			ReplicationFactor: 2,
 		},
-		{
-			Topic:             GetStepKafkaTopic(),
+	}
+	for _, priority := range repository.Priorities {
+		topicConfigs = append(topicConfigs, kafka.TopicConfig{
+			Topic:             PriorityTopic(GetStepKafkaTopic(), priority),
 			NumPartitions:     3,
 			ReplicationFactor: 2,
-		},
+		})
 	}
 	for _, topic := range serviceTopics {
 		topicConfigs = append(topicConfigs, kafka.TopicConfig{
@@ -4,6 +4,8 @@ import (
 	"context"
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"log/slog"
+	"priorityfetcher"
+	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
@@ -41,19 +43,73 @@ import (
 
 var consumerLogger = otelslog.NewLogger("kafka-consumer")
 
-func ConsumeMessageWithHandler(c *kafka.Reader, timeout time.Duration, handler func([]byte, []kafka.Header)) {
+// ConsumeMessageWithHandler handles the messages of the readers, which are ordered from the highest priority to the lowest.
+// A message of a reader is only taken when the readers before it have none waiting. At most poolSize messages are
+// handled at a time, no more messages are fetched while the pool is full. Offsets are committed in order, a message
+// is committed once it and every message fetched before it from its partition were handled.
+// Once the context is done it stops fetching, waits for the messages being handled and closes the readers
+func ConsumeMessageWithHandler(ctx context.Context, readers []*kafka.Reader, timeout time.Duration, poolSize int, handler func([]byte, []kafka.Header)) {
+	fetched := make([]chan kafka.Message, len(readers))
+	trackers := make([]*offsetTracker, len(readers))
+	for i, reader := range readers {
+		fetched[i] = make(chan kafka.Message)
+		trackers[i] = newOffsetTracker(func(msg kafka.Message) error {
+			return reader.CommitMessages(context.Background(), msg)
+		})
+		go fetchMessages(ctx, reader, trackers[i], fetched[i])
+	}
 
-	// A signal handler or similar could be used to set this to false to break the loop.
+	pool := make(chan struct{}, max(poolSize, 1))
+	inFlight := sync.WaitGroup{}
+	for ctx.Err() == nil {
+		select {
+		case pool <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		i, msg, ok := priorityfetcher.Next(ctx, fetched)
+		if !ok {
+			<-pool
+			continue
+		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-pool }()
+			handler(msg.Value, msg.Headers)
+			err := trackers[i].done(msg)
+			if err != nil {
+				consumerLogger.Error("Error commiting message", slog.Any("err", err))
+			}
+		}()
+	}
+
+	inFlight.Wait()
+	// Closing the readers flushes their commits
+	for _, reader := range readers {
+		err := reader.Close()
+		if err != nil {
+			consumerLogger.Error("Error closing reader", slog.Any("err", err))
+		}
+	}
+}
+
+// fetchMessages sends the messages of the reader to the channel, it fetches the next one once the previous one was taken.
+// The messages are tracked in the order they were fetched, it stops once the context is done
+func fetchMessages(ctx context.Context, c *kafka.Reader, tracker *offsetTracker, messages chan<- kafka.Message) {
 	for {
-		msg, err := c.FetchMessage(context.Background())
+		msg, err := c.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err == nil {
-			go func() {
-				handler(msg.Value, msg.Headers)
-				err := c.CommitMessages(context.Background(), msg)
-				if err != nil {
-				    consumerLogger.Error("Error commiting message", slog.Any("err", err))
-				}
-			}()
+			tracker.fetched(msg)
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				// Never handled nor committed, it is fetched again once the consumer restarts
+				return
+			}
 		} else {
 			// The client will automatically try to recover from all errors.
 			// Timeout is not considered an error because it is raised by
@@ -62,3 +118,61 @@ func ConsumeMessageWithHandler(c *kafka.Reader, timeout time.Duration, handler f
 		}
 	}
 }
+
+// offsetTracker commits the messages of a reader in the order they were fetched from each partition,
+// so that a crash never commits a message that was fetched after one that wasn't handled
+type offsetTracker struct {
+	mu         sync.Mutex
+	commit     func(msg kafka.Message) error
+	partitions map[int]*partitionOffsets
+}
+
+// partitionOffsets are the offsets of a partition that were fetched and not committed yet, in order,
+// along with the ones of them that were handled
+type partitionOffsets struct {
+	pending []int64
+	handled map[int64]kafka.Message
+}
+
+func newOffsetTracker(commit func(msg kafka.Message) error) *offsetTracker {
+	return &offsetTracker{commit: commit, partitions: make(map[int]*partitionOffsets)}
+}
+
+// fetched tracks a message that is about to be handled
+func (t *offsetTracker) fetched(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partition, ok := t.partitions[msg.Partition]
+	if !ok {
+		partition = &partitionOffsets{handled: make(map[int64]kafka.Message)}
+		t.partitions[msg.Partition] = partition
+	}
+	partition.pending = append(partition.pending, msg.Offset)
+}
+
+// done marks the message as handled and commits the last of the messages of its partition
+// that were handled along with every message before them
+func (t *offsetTracker) done(msg kafka.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partition, ok := t.partitions[msg.Partition]
+	if !ok {
+		return t.commit(msg)
+	}
+	partition.handled[msg.Offset] = msg
+	var last *kafka.Message
+	for len(partition.pending) > 0 {
+		handled, ok := partition.handled[partition.pending[0]]
+		if !ok {
+			break
+		}
+		delete(partition.handled, partition.pending[0])
+		partition.pending = partition.pending[1:]
+		last = &handled
+	}
+	if last == nil {
+		return nil
+	}
+	// Committed while locked, so that commits of the partition are never reordered
+	return t.commit(*last)
+}
@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	committed := make([]int64, 0)
+	tracker := newOffsetTracker(func(msg kafka.Message) error {
+		committed = append(committed, msg.Offset)
+		return nil
+	})
+	messages := []kafka.Message{{Partition: 0, Offset: 1}, {Partition: 0, Offset: 2}, {Partition: 1, Offset: 7}, {Partition: 0, Offset: 3}}
+	for _, msg := range messages {
+		tracker.fetched(msg)
+	}
+
+	// Messages handled before the earlier ones of their partition wait for them
+	steps := []struct {
+		msg  kafka.Message
+		want []int64
+	}{
+		{msg: messages[1], want: []int64{}},
+		{msg: messages[3], want: []int64{}},
+		{msg: messages[2], want: []int64{7}},
+		{msg: messages[0], want: []int64{7, 3}},
+	}
+	for _, step := range steps {
+		err := tracker.done(step.msg)
+		if err != nil {
+			t.Fatalf("done() error = %v", err)
+		}
+		if !reflect.DeepEqual(committed, step.want) {
+			t.Errorf("committed after offset %d = %v, want %v", step.msg.Offset, committed, step.want)
+		}
+	}
+}
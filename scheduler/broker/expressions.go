@@ -0,0 +1,672 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"scheduler/repository"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/goccy/go-json"
+)
+
+// Inputs are templates where each ${{ expression }} is replaced by its value, $${{ is kept as a literal ${{.
+// An input that is a single expression keeps the type of its value.
+// Expressions reference args.<key>, steps.<name>.outputs.<key>, error.<field>, and item and index in foreach items,
+// nested values are read with .field and [index], JSON strings included.
+// They support numbers, 'strings', + - * / % and functions like default(value, fallback) or upper(value)
+var templateMatcher = regexp.MustCompile(`\$?\$\{\{(.*?)\}\}`)
+
+// Legacy input syntax, kept for the workflows that use it
+var (
+	argsMatcher  = regexp.MustCompile(`\$args\.(.+)`)
+	errorMatcher = regexp.MustCompile(`\$error\.(.+)`)
+	itemMatcher  = regexp.MustCompile(`^\$item(\.(.+))?$`)
+)
+
+// undefinedError is returned when an expression references a value that doesn't exist
+type undefinedError struct {
+	reference string
+}
+
+func (e *undefinedError) Error() string {
+	return fmt.Sprintf("%s is not defined", e.reference)
+}
+
+// invalidReferenceError is returned when an input references an output that a step of the execution doesn't have
+type invalidReferenceError struct {
+	reference string
+}
+
+func (e *invalidReferenceError) Error() string {
+	return fmt.Sprintf("invalid reference %s, the step has no such output", e.reference)
+}
+
+// expressionScope holds the values that the inputs of a step can reference
+type expressionScope struct {
+	args    map[string]interface{}
+	outputs map[string]interface{}
+	error   map[string]interface{}
+	item    interface{}
+	// index is the position of the item of a foreach step, -1 for the rest of the steps
+	index int
+	// stepNames returns the steps of the execution, legacy references to their outputs have to exist.
+	// Only called when a reference is not found, so that dispatching a step doesn't look them up
+	stepNames func() []string
+}
+
+// resolveInput returns the value of an input of a step
+func (s *expressionScope) resolveInput(input string) (interface{}, error) {
+	if templateMatcher.MatchString(input) {
+		return s.interpolate(input)
+	}
+	if argsMatcher.MatchString(input) {
+		key := strings.Replace(input, "$args.", "", 1)
+		if result, ok := s.args[key]; ok {
+			return result, nil
+		}
+		return nil, fmt.Errorf("required argument not found: %s", input)
+	}
+	if s.index >= 0 && input == "$index" {
+		return s.index, nil
+	}
+	if s.index >= 0 && itemMatcher.MatchString(input) {
+		if result, ok := itemField(s.item, itemMatcher.FindStringSubmatch(input)[2]); ok {
+			return result, nil
+		}
+		return nil, fmt.Errorf("required argument not found: %s", input)
+	}
+	if errorMatcher.MatchString(input) {
+		if result, ok := s.error[strings.Replace(input, "$error.", "", 1)]; ok {
+			return result, nil
+		}
+		return nil, fmt.Errorf("required argument not found: %s", input)
+	}
+	if result, ok := s.outputs[input]; ok {
+		return result, nil
+	}
+	if name, _, found := strings.Cut(input, "."); found && s.isStep(name) {
+		return nil, &invalidReferenceError{reference: input}
+	}
+	// Use hardcoded value
+	return input, nil
+}
+
+// isStep reports whether the name is a step of the execution or an item of one of its foreach steps
+func (s *expressionScope) isStep(name string) bool {
+	if foreach, _, ok := repository.ParseItemStepName(name); ok {
+		name = foreach
+	}
+	return s.stepNames != nil && slices.Contains(s.stepNames(), name)
+}
+
+// interpolate replaces the expressions of a template by their values
+func (s *expressionScope) interpolate(template string) (interface{}, error) {
+	matches := templateMatcher.FindAllStringSubmatchIndex(template, -1)
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(template) && !strings.HasPrefix(template, "$$") {
+		return s.evaluate(template[matches[0][2]:matches[0][3]])
+	}
+	var builder strings.Builder
+	last := 0
+	for _, match := range matches {
+		builder.WriteString(template[last:match[0]])
+		last = match[1]
+		if strings.HasPrefix(template[match[0]:], "$$") {
+			builder.WriteString(template[match[0]+1 : match[1]])
+			continue
+		}
+		value, err := s.evaluate(template[match[2]:match[3]])
+		if err != nil {
+			return nil, err
+		}
+		builder.WriteString(stringValue(value))
+	}
+	builder.WriteString(template[last:])
+	return builder.String(), nil
+}
+
+// evaluate parses and evaluates an expression
+func (s *expressionScope) evaluate(expression string) (interface{}, error) {
+	node, err := parseExpression(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", strings.TrimSpace(expression), err)
+	}
+	return node.eval(s)
+}
+
+// steps groups the outputs by the step that produced them
+func (s *expressionScope) steps() map[string]interface{} {
+	steps := make(map[string]interface{})
+	for key, value := range s.outputs {
+		name, output, found := strings.Cut(key, ".")
+		if !found {
+			continue
+		}
+		if _, ok := steps[name]; !ok {
+			steps[name] = map[string]interface{}{"outputs": make(map[string]interface{})}
+		}
+		steps[name].(map[string]interface{})["outputs"].(map[string]interface{})[output] = value
+	}
+	return steps
+}
+
+// stringValue formats a value to be part of a string
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return outputValue(v)
+	}
+}
+
+// numberValue converts numbers and numeric strings to float64
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// jsonValue decodes the JSON objects and arrays stored as strings, so that their fields can be read
+func jsonValue(value interface{}) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	trimmed := strings.TrimSpace(str)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return value
+	}
+	var decoded interface{}
+	if json.Unmarshal([]byte(trimmed), &decoded) != nil {
+		return value
+	}
+	return decoded
+}
+
+type expressionNode interface {
+	eval(s *expressionScope) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(*expressionScope) (interface{}, error) {
+	return n.value, nil
+}
+
+type referenceNode struct {
+	name string
+}
+
+func (n *referenceNode) eval(s *expressionScope) (interface{}, error) {
+	switch n.name {
+	case "args":
+		return s.args, nil
+	case "steps":
+		return s.steps(), nil
+	case "error":
+		if len(s.error) == 0 {
+			return nil, &undefinedError{reference: "error"}
+		}
+		return s.error, nil
+	case "item":
+		if s.index < 0 {
+			return nil, &undefinedError{reference: "item"}
+		}
+		return s.item, nil
+	case "index":
+		if s.index < 0 {
+			return nil, &undefinedError{reference: "index"}
+		}
+		return float64(s.index), nil
+	}
+	return nil, fmt.Errorf("unknown reference %s", n.name)
+}
+
+// accessNode reads a field of an object or an element of an array
+type accessNode struct {
+	target expressionNode
+	key    expressionNode
+	source string
+}
+
+func (n *accessNode) eval(s *expressionScope) (interface{}, error) {
+	target, err := n.target.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch v := jsonValue(target).(type) {
+	case map[string]interface{}:
+		if value, ok := v[stringValue(key)]; ok {
+			return value, nil
+		}
+	case []interface{}:
+		if index, ok := numberValue(key); ok && index == math.Trunc(index) && index >= 0 && int(index) < len(v) {
+			return v[int(index)], nil
+		}
+	}
+	return nil, &undefinedError{reference: n.source}
+}
+
+type unaryNode struct {
+	operand expressionNode
+}
+
+func (n *unaryNode) eval(s *expressionScope) (interface{}, error) {
+	value, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	number, ok := numberValue(value)
+	if !ok {
+		return nil, fmt.Errorf("can't negate %v", value)
+	}
+	return -number, nil
+}
+
+type binaryNode struct {
+	operator    string
+	left, right expressionNode
+}
+
+func (n *binaryNode) eval(s *expressionScope) (interface{}, error) {
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	leftNumber, leftOk := numberValue(left)
+	rightNumber, rightOk := numberValue(right)
+	if n.operator == "+" && (!leftOk || !rightOk) {
+		return stringValue(left) + stringValue(right), nil
+	}
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("%v %s %v needs two numbers", left, n.operator, right)
+	}
+	switch n.operator {
+	case "+":
+		return leftNumber + rightNumber, nil
+	case "-":
+		return leftNumber - rightNumber, nil
+	case "*":
+		return leftNumber * rightNumber, nil
+	case "/":
+		if rightNumber == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return leftNumber / rightNumber, nil
+	default:
+		if rightNumber == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(leftNumber, rightNumber), nil
+	}
+}
+
+type callNode struct {
+	function string
+	args     []expressionNode
+}
+
+func (n *callNode) eval(s *expressionScope) (interface{}, error) {
+	if n.function == "default" {
+		if len(n.args) != 2 {
+			return nil, fmt.Errorf("default takes 2 arguments")
+		}
+		value, err := n.args[0].eval(s)
+		var undefined *undefinedError
+		if errors.As(err, &undefined) || (err == nil && (value == nil || value == "")) {
+			return n.args[1].eval(s)
+		}
+		return value, err
+	}
+	function, ok := expressionFunctions[n.function]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", n.function)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	if function.args >= 0 && len(args) != function.args {
+		return nil, fmt.Errorf("%s takes %d arguments", n.function, function.args)
+	}
+	return function.fn(args)
+}
+
+type expressionFunction struct {
+	// args is the number of arguments, -1 for any
+	args int
+	fn   func(args []interface{}) (interface{}, error)
+}
+
+var expressionFunctions = map[string]expressionFunction{
+	"upper": {1, func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(stringValue(args[0])), nil
+	}},
+	"lower": {1, func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(stringValue(args[0])), nil
+	}},
+	"trim": {1, func(args []interface{}) (interface{}, error) {
+		return strings.TrimSpace(stringValue(args[0])), nil
+	}},
+	"replace": {3, func(args []interface{}) (interface{}, error) {
+		return strings.ReplaceAll(stringValue(args[0]), stringValue(args[1]), stringValue(args[2])), nil
+	}},
+	"split": {2, func(args []interface{}) (interface{}, error) {
+		parts := make([]interface{}, 0)
+		for _, part := range strings.Split(stringValue(args[0]), stringValue(args[1])) {
+			parts = append(parts, part)
+		}
+		return parts, nil
+	}},
+	"join": {2, func(args []interface{}) (interface{}, error) {
+		list, ok := jsonValue(args[0]).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("join needs an array: %v", args[0])
+		}
+		parts := make([]string, len(list))
+		for i, value := range list {
+			parts[i] = stringValue(value)
+		}
+		return strings.Join(parts, stringValue(args[1])), nil
+	}},
+	"concat": {-1, func(args []interface{}) (interface{}, error) {
+		var builder strings.Builder
+		for _, arg := range args {
+			builder.WriteString(stringValue(arg))
+		}
+		return builder.String(), nil
+	}},
+	"length": {1, func(args []interface{}) (interface{}, error) {
+		switch v := jsonValue(args[0]).(type) {
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		default:
+			return float64(len([]rune(stringValue(v)))), nil
+		}
+	}},
+	"substring": {-1, func(args []interface{}) (interface{}, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf("substring takes 2 or 3 arguments")
+		}
+		runes := []rune(stringValue(args[0]))
+		start, ok := numberValue(args[1])
+		if !ok || start < 0 || int(start) > len(runes) {
+			return nil, fmt.Errorf("substring start is out of range: %v", args[1])
+		}
+		end := len(runes)
+		if len(args) == 3 {
+			length, ok := numberValue(args[2])
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("substring length is not valid: %v", args[2])
+			}
+			end = min(int(start)+int(length), len(runes))
+		}
+		return string(runes[int(start):end]), nil
+	}},
+	"toJSON": {1, func(args []interface{}) (interface{}, error) {
+		bytes, err := json.Marshal(args[0])
+		return string(bytes), err
+	}},
+	"fromJSON": {1, func(args []interface{}) (interface{}, error) {
+		var value interface{}
+		err := json.Unmarshal([]byte(stringValue(args[0])), &value)
+		if err != nil {
+			return nil, fmt.Errorf("fromJSON needs valid JSON: %s", args[0])
+		}
+		return value, nil
+	}},
+	"string": {1, func(args []interface{}) (interface{}, error) {
+		return stringValue(args[0]), nil
+	}},
+	"number": {1, func(args []interface{}) (interface{}, error) {
+		number, ok := numberValue(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", args[0])
+		}
+		return number, nil
+	}},
+}
+
+type expressionToken struct {
+	kind  string // number, string, name or the operator itself
+	value string
+	end   int
+}
+
+func tokenizeExpression(expression string) ([]expressionToken, error) {
+	tokens := make([]expressionToken, 0)
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: "number", value: string(runes[start:i]), end: i})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: "name", value: string(runes[start:i]), end: i})
+		case r == '\'' || r == '"':
+			var builder strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				builder.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, expressionToken{kind: "string", value: builder.String(), end: i})
+		case strings.ContainsRune("+-*/%()[],.", r):
+			i++
+			tokens = append(tokens, expressionToken{kind: string(r), value: string(r), end: i})
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+// expressionParser is a recursive descent parser, from the lowest precedence to the highest:
+// + -, * / %, unary -, and function calls, fields and indexes
+type expressionParser struct {
+	source []rune
+	tokens []expressionToken
+	pos    int
+}
+
+func parseExpression(expression string) (expressionNode, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	parser := &expressionParser{source: []rune(expression), tokens: tokens}
+	node, err := parser.additive()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s", tokens[parser.pos].value)
+	}
+	return node, nil
+}
+
+func (p *expressionParser) peek(kind string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind
+}
+
+func (p *expressionParser) expect(kind string) (expressionToken, error) {
+	if !p.peek(kind) {
+		if p.pos < len(p.tokens) {
+			return expressionToken{}, fmt.Errorf("expected %s but found %s", kind, p.tokens[p.pos].value)
+		}
+		return expressionToken{}, fmt.Errorf("expected %s at the end", kind)
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *expressionParser) additive() (expressionNode, error) {
+	node, err := p.multiplicative()
+	for err == nil && (p.peek("+") || p.peek("-")) {
+		operator := p.tokens[p.pos].kind
+		p.pos++
+		var right expressionNode
+		right, err = p.multiplicative()
+		node = &binaryNode{operator: operator, left: node, right: right}
+	}
+	return node, err
+}
+
+func (p *expressionParser) multiplicative() (expressionNode, error) {
+	node, err := p.unary()
+	for err == nil && (p.peek("*") || p.peek("/") || p.peek("%")) {
+		operator := p.tokens[p.pos].kind
+		p.pos++
+		var right expressionNode
+		right, err = p.unary()
+		node = &binaryNode{operator: operator, left: node, right: right}
+	}
+	return node, err
+}
+
+func (p *expressionParser) unary() (expressionNode, error) {
+	if p.peek("-") {
+		p.pos++
+		operand, err := p.unary()
+		return &unaryNode{operand: operand}, err
+	}
+	return p.postfix()
+}
+
+func (p *expressionParser) postfix() (expressionNode, error) {
+	start := p.pos
+	node, err := p.primary()
+	for err == nil && (p.peek(".") || p.peek("[")) {
+		var key expressionNode
+		if p.peek(".") {
+			p.pos++
+			var name expressionToken
+			name, err = p.expect("name")
+			key = &literalNode{value: name.value}
+		} else {
+			p.pos++
+			key, err = p.additive()
+			if err == nil {
+				_, err = p.expect("]")
+			}
+		}
+		node = &accessNode{target: node, key: key, source: p.sourceBetween(start, p.pos)}
+	}
+	return node, err
+}
+
+func (p *expressionParser) primary() (expressionNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case "number":
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token.value)
+		}
+		return &literalNode{value: number}, nil
+	case "string":
+		return &literalNode{value: token.value}, nil
+	case "(":
+		node, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(")")
+		return node, err
+	case "name":
+		switch token.value {
+		case "true", "false":
+			return &literalNode{value: token.value == "true"}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if !p.peek("(") {
+			return &referenceNode{name: token.value}, nil
+		}
+		p.pos++
+		call := &callNode{function: token.value, args: make([]expressionNode, 0)}
+		for !p.peek(")") {
+			if len(call.args) > 0 {
+				if _, err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		p.pos++
+		return call, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", token.value)
+}
+
+// sourceBetween returns the text of the tokens from start to end, to name references in errors
+func (p *expressionParser) sourceBetween(start int, end int) string {
+	from := 0
+	if start > 0 {
+		from = p.tokens[start-1].end
+	}
+	return strings.TrimSpace(string(p.source[from:p.tokens[end-1].end]))
+}
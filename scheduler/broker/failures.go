@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"scheduler/repository"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stepError normalizes the error output of a step into the error envelope. Objects that use msg for the message
+// or leave retryable out are understood, and errors that are only a message are raised by the scheduler itself
+func stepError(outputErr interface{}) *repository.StepError {
+	switch e := outputErr.(type) {
+	case *repository.StepError:
+		return e
+	case map[string]interface{}:
+		stepErr := &repository.StepError{Code: "unknown", Retryable: true, Details: e["details"]}
+		if code, ok := e["code"].(string); ok && code != "" {
+			stepErr.Code = code
+		}
+		if message, ok := e["message"].(string); ok {
+			stepErr.Message = message
+		} else if msg, ok := e["msg"]; ok {
+			stepErr.Message = stringValue(msg)
+		}
+		if retryable, ok := e["retryable"].(bool); ok {
+			stepErr.Retryable = retryable
+		}
+		if worker, ok := e["worker"].(string); ok {
+			stepErr.Worker = worker
+		}
+		if attempt, ok := numberValue(e["attempt"]); ok {
+			stepErr.Attempt = uint(attempt)
+		}
+		return stepErr
+	default:
+		return &repository.StepError{Code: "scheduler", Message: stringValue(e), Worker: "scheduler"}
+	}
+}
+
+// recordStepError stores the error envelope of the last failure on the step
+func recordStepError(stepState *repository.StepState, stepErr *repository.StepError) {
+	if stepErr.Worker == "" {
+		stepErr.Worker = "scheduler"
+	}
+	stepErr.Attempt = stepState.Attempt
+	stepState.Error = repository.NewJSONValue(stepErr)
+}
+
+// setErrorOutput replaces the error output of the execution, the steps that run after the failure read it as error
+func (h *Handler) setErrorOutput(ctx context.Context, state *repository.State, stepErr *repository.StepError) {
+	h.setOutput(ctx, state, "error", stepErr)
+}
+
+// failStep fails the step with the given error and routes the execution into its failure branch
+func (h *Handler) failStep(
+	ctx context.Context,
+	span trace.Span,
+	state *repository.State,
+	stepState *repository.StepState,
+	outputErr interface{},
+) {
+	stepErr := stepError(outputErr)
+	if stepState != nil {
+		stepState.Status = repository.FAILED
+		recordStepError(stepState, stepErr)
+		h.executionRepository.UpdateStepState(context.Background(), stepState)
+		log.Printf("Step %s of execution %d failed: %s\n", stepState.Name, state.ExecutionID, stepErr.Message)
+	}
+	h.setErrorOutput(ctx, state, stepErr)
+	h.failExecution(ctx, span, state)
+}
+
+// failExecution routes the execution into its failure branch after one of its steps failed, the steps that are
+// still active are cancelled and their responses ignored. A failure of the workflow runs the compensations,
+// the onFailure steps and the finally steps. A failure while compensating or running the onFailure steps
+// skips to the finally steps, and a failure of the finally steps ends the execution
+func (h *Handler) failExecution(ctx context.Context, span trace.Span, state *repository.State) {
+	h.cancelActiveSteps(ctx, state)
+	switch {
+	case state.Status == repository.COMPENSATING:
+		log.Printf("Compensation of execution %d failed\n", state.ExecutionID)
+		state.Outcome = repository.COMPENSATION_FAILED
+		h.continueWithPhases(ctx, span, state, repository.ON_FAILURE, repository.FINALLY)
+	case state.Phase == repository.ON_FAILURE:
+		h.continueWithPhases(ctx, span, state, repository.FINALLY)
+	case state.Phase == repository.FINALLY:
+		if state.Outcome == repository.SUCCESS {
+			state.Outcome = repository.FAILED
+		}
+		h.continueWithPhases(ctx, span, state)
+	default:
+		state.Outcome = repository.FAILED
+		h.runCompensations(ctx, span, state)
+	}
+}
+
+// cancelActiveSteps cancels the steps that are still active, along with the subworkflows they started.
+// The concurrency leases of the executing steps are released and the queued steps leave the queue
+func (h *Handler) cancelActiveSteps(ctx context.Context, state *repository.State) {
+	cancelled := false
+	executing := make([]*repository.StepState, 0)
+	for _, stepState := range state.StepStates {
+		if stepState.IsActive() {
+			if stepState.Status == repository.EXECUTING {
+				executing = append(executing, stepState)
+			}
+			stepState.Status = repository.CANCELLED
+			h.executionRepository.UpdateStepState(context.Background(), stepState)
+			cancelled = true
+		}
+	}
+	if cancelled {
+		h.executionRepository.DeleteQueuedSteps(ctx, state.ExecutionID)
+		span := trace.SpanFromContext(ctx)
+		for _, stepState := range executing {
+			h.releaseConcurrency(ctx, span, stepState)
+		}
+		h.cancelChildExecutions(ctx, state.ExecutionID)
+	}
+}
@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// foreachItems parses the items of a foreach step, they come as a list from the arguments or as JSON from the outputs
+func foreachItems(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case string:
+		items := make([]interface{}, 0)
+		err := json.Unmarshal([]byte(v), &items)
+		if err != nil {
+			return nil, fmt.Errorf("items is not a JSON array: %s", v)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("items is not a JSON array: %v", v)
+	}
+}
+
+// foreachConcurrency parses how many items of a foreach step run at the same time, 0 runs all of them
+func foreachConcurrency(value interface{}) (int, error) {
+	var concurrency int
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		concurrency = int(v)
+	case string:
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("concurrency is not a number: %s", v)
+		}
+		concurrency = parsed
+	default:
+		return 0, fmt.Errorf("concurrency is not a number: %v", v)
+	}
+	if concurrency < 0 {
+		return 0, fmt.Errorf("concurrency can't be negative: %d", concurrency)
+	}
+	return concurrency, nil
+}
+
+// itemField returns the item itself or one of its fields, for $item and $item.field inputs
+func itemField(item interface{}, field string) (interface{}, bool) {
+	if field == "" {
+		return item, item != nil
+	}
+	object, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := object[field]
+	return value, ok
+}
+
+// ForeachHandler runs the template of the step once per item of the items input,
+// at most concurrency items at the same time. The step keeps executing until every item succeeds
+func (h *Handler) ForeachHandler(
+	step repository.ExecutionStepDTO,
+	state *repository.State,
+	inputs map[string]interface{},
+	span trace.Span,
+	ctx context.Context,
+) {
+	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	stepState := state.GetStepState(step.Name)
+	if execution.GetStep(repository.TemplateStepName(step.Name)) == nil {
+		h.failStep(ctx, span, state, stepState, fmt.Sprintf("Step %s has no template", step.Name))
+		return
+	}
+	items, err := foreachItems(inputs["items"])
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	concurrency, err := foreachConcurrency(inputs["concurrency"])
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	h.setOutput(ctx, state, step.Name+".items", items)
+	h.setOutput(ctx, state, step.Name+".concurrency", concurrency)
+	span.SetAttributes(attribute.Int("Items", len(items)))
+
+	stepState.Status = repository.EXECUTING
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	h.advanceExecution(ctx, span, state, h.continueForeach(ctx, span, execution, step.Name))
+}
+
+// continueForeach returns the items of the foreach step to dispatch next, keeping the concurrency limit.
+// Items that succeeded in a previous attempt of the execution are not run again.
+// Once every item succeeded their outputs are collected in order, the step succeeds and the steps that depend on it are returned
+func (h *Handler) continueForeach(
+	ctx context.Context,
+	span trace.Span,
+	execution *repository.Execution,
+	foreach string,
+) []*repository.Step {
+	state := execution.State
+	outputs := make(map[string]interface{})
+	for _, output := range state.Outputs {
+		outputs[output.Key] = output.Value.Decode()
+	}
+	items, err := foreachItems(outputs[foreach+".items"])
+	if err != nil {
+		span.RecordError(err)
+		return nil
+	}
+	concurrency, _ := foreachConcurrency(outputs[foreach+".concurrency"])
+
+	running := 0
+	pending := make([]*repository.Step, 0)
+	for i := range items {
+		itemState := state.GetStepState(repository.ItemStepName(foreach, i))
+		if itemState != nil && itemState.IsActive() {
+			running++
+		} else if itemState == nil || itemState.Status != repository.SUCCESS {
+			pending = append(pending, execution.GetStep(repository.ItemStepName(foreach, i)))
+		}
+	}
+	if running > 0 || len(pending) > 0 {
+		if concurrency > 0 {
+			available := max(concurrency-running, 0)
+			pending = pending[:min(available, len(pending))]
+		}
+		return pending
+	}
+
+	collected := make([]map[string]interface{}, len(items))
+	for i := range items {
+		prefix := repository.ItemStepName(foreach, i) + "."
+		collected[i] = make(map[string]interface{})
+		for key, value := range outputs {
+			if strings.HasPrefix(key, prefix) {
+				collected[i][strings.TrimPrefix(key, prefix)] = value
+			}
+		}
+	}
+	bytes, err := json.Marshal(collected)
+	if err != nil {
+		span.RecordError(err)
+	}
+	h.setOutput(ctx, state, foreach+".outputs", collected)
+	log.Printf("Foreach %s of execution %d finished %d items\n", foreach, state.ExecutionID, len(items))
+
+	stepState := state.GetStepState(foreach)
+	stepState.Status = repository.SUCCESS
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	h.finishLatestStepRun(ctx, state.ExecutionID, foreach, repository.SUCCESS, bytes)
+	return execution.ReadySteps(foreach)
+}
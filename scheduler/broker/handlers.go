@@ -2,14 +2,14 @@ package broker
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"log"
-	"reflect"
-	"regexp"
 	"scheduler/jobs"
 	"scheduler/repository"
-	"strings"
+	"time"
 
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/otel"
@@ -26,18 +26,22 @@ var handlerLogger = otelslog.NewLogger("handlers")
 type Handler struct {
 	executionRepository    *repository.ExecutionRepository
 	serviceRepository      *repository.ServiceRepository
-	executionStepsWriter   *kafka.Writer
+	executionStepsWriters  map[string]*kafka.Writer // Writers of the steps topics by priority
 	jobsRepository         *jobs.JobsRepository
-	servicesWriters        map[string]*kafka.Writer
+	servicesWriters        map[string]map[string]*kafka.Writer // Writers of the input topics of the services by priority
 	produceMessageFunction func(writer *kafka.Writer, headers []kafka.Header, message []byte) error
 	tracer                 trace.Tracer
+	// outboxReady wakes up the outbox relay when messages are enqueued
+	outboxReady chan struct{}
+	// base is the handler a transaction was started from, nil outside transactions
+	base *Handler
 }
 
 func NewHandler(
 	executionRepository *repository.ExecutionRepository,
 	serviceRepository *repository.ServiceRepository,
-	executionStepsWriter *kafka.Writer,
-	servicesWriters map[string]*kafka.Writer,
+	executionStepsWriters map[string]*kafka.Writer,
+	servicesWriters map[string]map[string]*kafka.Writer,
 	tracerProvider trace.TracerProvider,
 	jobsRepository *jobs.JobsRepository,
 	produceMessageFunction func(writer *kafka.Writer, headers []kafka.Header, message []byte) error,
@@ -45,28 +49,135 @@ func NewHandler(
 	return &Handler{
 		executionRepository,
 		serviceRepository,
-		executionStepsWriter,
+		executionStepsWriters,
 		jobsRepository,
 		servicesWriters,
 		produceMessageFunction,
 		tracerProvider.Tracer("kafka-handlers"),
+		make(chan struct{}, 1),
+		nil,
 	}
 }
 
-func (h *Handler) EnqueueExecutionStep(stepToExecute repository.ExecutionStepDTO, ctx context.Context, span trace.Span) {
+// EnqueueExecutionStep enqueues the step on the steps topic of the priority of its execution
+func (h *Handler) EnqueueExecutionStep(stepToExecute repository.ExecutionStepDTO, priority string, ctx context.Context, span trace.Span) error {
 	//Enqueue the step
 	bytes, err := json.Marshal(stepToExecute)
 	if err != nil {
 		log.Printf("Failed to marshal message: %s\n", err)
 		span.RecordError(err)
-		return
+		return err
 	}
-	err = h.produceMessageFunction(h.executionStepsWriter, h.PassHeader(ctx), bytes)
+	err = h.enqueue(ctx, "", priority, bytes)
 	if err != nil {
-		log.Printf("Failed to produce message: %s\n", err)
+		log.Printf("Failed to enqueue message: %s\n", err)
 		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// enqueueRootSteps enqueues every step without dependencies of a newly created execution,
+// their step states are created as pending by the submission
+func (h *Handler) enqueueRootSteps(execution *repository.Execution, ctx context.Context, span trace.Span) {
+	for _, step := range execution.RootSteps() {
+		if stepState := execution.State.GetStepState(step.Name); stepState != nil {
+			stepState.DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			h.executionRepository.UpdateStepState(ctx, stepState)
+		}
+		_ = h.EnqueueExecutionStep(step.ToExecutionStepDTO(), execution.State.Priority, ctx, span)
+	}
+}
+
+// dispatchStep marks the step as pending and enqueues it, creating its step state on the first dispatch
+func (h *Handler) dispatchStep(ctx context.Context, span trace.Span, state *repository.State, step *repository.Step) error {
+	stepState := state.GetStepState(step.Name)
+	if stepState == nil {
+		stepState = &repository.StepState{
+			StateID: state.ID,
+			Name:    step.Name,
+		}
+		state.StepStates = append(state.StepStates, stepState)
+	}
+	stepState.Status = repository.PENDING
+	stepState.Attempt = 1
+	stepState.DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	h.executionRepository.UpdateStepState(ctx, stepState)
+	return h.EnqueueExecutionStep(step.ToExecutionStepDTO(), state.Priority, ctx, span)
+}
+
+// setOutput replaces the output with the given key, it is saved with the state as JSON
+func (h *Handler) setOutput(ctx context.Context, state *repository.State, key string, value interface{}) {
+	outputs := make([]*repository.KeyValueOutput, 0, len(state.Outputs)+1)
+	for _, output := range state.Outputs {
+		if output.Key == key {
+			h.executionRepository.DeleteOutput(ctx, output)
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+	state.Outputs = append(outputs, &repository.KeyValueOutput{Key: key, Value: repository.NewJSONValue(value)})
+}
+
+// holdStep marks the step as pending without enqueuing it, it is enqueued once the execution is resumed
+func (h *Handler) holdStep(ctx context.Context, state *repository.State, step *repository.Step) {
+	stepState := state.GetStepState(step.Name)
+	if stepState == nil {
+		stepState = &repository.StepState{
+			StateID: state.ID,
+			Name:    step.Name,
+		}
+		state.StepStates = append(state.StepStates, stepState)
+	}
+	stepState.Status = repository.PENDING
+	stepState.Attempt = 1
+	h.executionRepository.UpdateStepState(ctx, stepState)
+}
+
+// refreshStatus derives the status of the execution from its steps, a paused execution stays paused while it has steps left.
+// The execution is waiting when its only active steps are waiting
+func refreshStatus(state *repository.State) {
+	if state.Status == repository.PAUSED && state.HasActiveSteps() {
 		return
 	}
+	if state.HasStepsWithStatus(repository.EXECUTING) {
+		state.Status = repository.EXECUTING
+	} else if state.HasStepsWithStatus(repository.WAITING) &&
+		!state.HasStepsWithStatus(repository.PENDING) && !state.HasStepsWithStatus(repository.RETRYING) {
+		state.Status = repository.WAITING
+	} else if state.HasActiveSteps() {
+		state.Status = repository.PENDING
+	} else {
+		state.Status = repository.SUCCESS
+	}
+}
+
+// advanceExecution dispatches the given steps and updates the execution status,
+// the current phase is complete once no step is left pending or executing.
+// While the execution is paused the steps are held until it is resumed,
+// and while it is compensating the next compensation is dispatched instead
+func (h *Handler) advanceExecution(ctx context.Context, span trace.Span, state *repository.State, next []*repository.Step) {
+	if state.Status == repository.COMPENSATING {
+		h.runCompensations(ctx, span, state)
+		return
+	}
+	for _, step := range next {
+		if state.Status == repository.PAUSED {
+			h.holdStep(ctx, state, step)
+			continue
+		}
+		err := h.dispatchStep(ctx, span, state, step)
+		if err != nil {
+			h.failStep(ctx, span, state, state.GetStepState(step.Name), fmt.Sprintf("Failed to enqueue step %s: %s", step.Name, err))
+			return
+		}
+	}
+	if !state.HasActiveSteps() {
+		h.completePhase(ctx, span, state)
+		return
+	}
+	refreshStatus(state)
+	h.executionRepository.UpdateState(context.Background(), state)
 }
 
 func (h *Handler) HandleExecutionSubmission(message []byte, header []kafka.Header) {
@@ -91,39 +202,47 @@ func (h *Handler) HandleExecutionSubmission(message []byte, header []kafka.Heade
 	var useUUID *bool
 	useUUID = new(bool)
 	*useUUID = true
-	if execution.Params != nil {
-		if execution.Params.CronDefinition.Valid {
-			h.jobsRepository.CreateCronJob(execution.Params.CronDefinition.String, ctx, func() {
-				executionCopy := submission.ToExecution(repository.PENDING)
-				executionCopy.JobID = executionCopy.ExecutionUUID
-				if !*useUUID {
-					executionCopy.ExecutionUUID = uuid.New().String()
-				} else {
-					*useUUID = false
-				}
-				h.executionRepository.CreateExecution(ctx, executionCopy)
-				stepToExecute := executionCopy.Steps[0].ToExecutionStepDTO()
-				h.EnqueueExecutionStep(stepToExecute, ctx, span)
-			}, execution.ExecutionUUID)
-		} else if execution.Params.DelayedSeconds > 0 {
-			h.jobsRepository.CreateDelayedJob(execution.Params.DelayedSeconds, ctx, func() {
-				execution.JobID = execution.ExecutionUUID
-				h.executionRepository.CreateExecution(ctx, execution)
-				stepToExecute := execution.Steps[0].ToExecutionStepDTO()
-				h.EnqueueExecutionStep(stepToExecute, ctx, span)
-			}, execution.ExecutionUUID)
-		}
+	// Every run of a cron or delayed execution gets its deadline when it starts
+	if execution.Params != nil && execution.Params.CronDefinition.Valid {
+		h.jobsRepository.CreateCronJob(execution.Params.CronDefinition.String, ctx, func() {
+			executionCopy := submission.ToExecution(repository.PENDING)
+			executionCopy.JobID = executionCopy.ExecutionUUID
+			if !*useUUID {
+				executionCopy.ExecutionUUID = uuid.New().String()
+			} else {
+				*useUUID = false
+			}
+			executionCopy.StartDeadline(time.Now())
+			h.InTransaction(ctx, func(tx *Handler) error {
+				tx.executionRepository.CreateExecution(ctx, executionCopy)
+				tx.enqueueRootSteps(executionCopy, ctx, span)
+				return nil
+			})
+		}, execution.ExecutionUUID)
+	} else if execution.Params != nil && execution.Params.DelayedSeconds > 0 {
+		h.jobsRepository.CreateDelayedJob(execution.Params.DelayedSeconds, ctx, func() {
+			execution.JobID = execution.ExecutionUUID
+			execution.StartDeadline(time.Now())
+			h.InTransaction(ctx, func(tx *Handler) error {
+				tx.executionRepository.CreateExecution(ctx, execution)
+				tx.enqueueRootSteps(execution, ctx, span)
+				return nil
+			})
+		}, execution.ExecutionUUID)
 	} else {
+		execution.StartDeadline(time.Now())
 		h.executionRepository.CreateExecution(ctx, execution)
-		stepToExecute := execution.Steps[0].ToExecutionStepDTO()
-		h.EnqueueExecutionStep(stepToExecute, ctx, span)
+		h.enqueueRootSteps(execution, ctx, span)
 	}
 }
 
 type ServiceMessage struct {
 	ExecutionId uint                   `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	TaskName    string                 `json:"taskName"`
 	Inputs      map[string]interface{} `json:"inputs"`
+	DispatchID  string                 `json:"dispatchId"`
+	Attempt     uint                   `json:"attempt"`
 }
 
 // Matches with all strings that start with args.
@@ -182,15 +301,25 @@ func (h *Handler) HandleExecutionStep(message []byte, header []kafka.Header) {
 
 	state := h.executionRepository.GetStateByExecutionID(ctx, step.ExecutionID)
 
-	if state.Status != repository.PENDING {
-		log.Printf("Execution not pending: %s\n", state.Status)
-		span.RecordError(fmt.Errorf("execution not pending: %s", state.Status))
+	if !state.IsActive() {
+		log.Printf("Execution not active: %s\n", state.Status)
+		span.RecordError(fmt.Errorf("execution not active: %s", state.Status))
+		return
+	}
+	stepState := state.GetStepState(step.Name)
+	if stepState == nil || stepState.Status != repository.PENDING {
+		log.Printf("Step not pending: %s\n", step.Name)
+		span.RecordError(fmt.Errorf("step not pending: %s", step.Name))
 		return
 	}
-	argsMatcher := regexp.MustCompile(`\$args\.(.+)`)
 	// Build corresponding inputs
-	argsMap := make(map[string]interface{})
-	outputMap := make(map[string]interface{})
+	scope := &expressionScope{
+		args:      make(map[string]interface{}),
+		outputs:   make(map[string]interface{}),
+		error:     make(map[string]interface{}),
+		index:     -1,
+		stepNames: func() []string { return h.executionRepository.GetStepNames(ctx, step.ExecutionID) },
+	}
 
 	for _, arg := range state.Arguments {
 		var value any
@@ -198,57 +327,91 @@ func (h *Handler) HandleExecutionStep(message []byte, header []kafka.Header) {
 		if err != nil {
 			log.Printf("Failed to unmarshal value: %s - %s\n", arg.Value, err.Error())
 			span.RecordError(err)
-			argsMap[arg.Key] = arg.Value
+			scope.args[arg.Key] = arg.Value
 		} else {
-			argsMap[arg.Key] = value
+			scope.args[arg.Key] = value
 		}
 	}
 
 	for _, output := range state.Outputs {
-		outputMap[output.Key] = output.Value
+		scope.outputs[output.Key] = output.Value.Decode()
+	}
+	// The error of a failed execution is available to the steps of its failure branch
+	if errorOutput, ok := jsonValue(scope.outputs["error"]).(map[string]interface{}); ok {
+		scope.error = errorOutput
+		// Errors used to only have a msg
+		if _, hasMsg := scope.error["msg"]; !hasMsg {
+			scope.error["msg"] = scope.error["message"]
+		}
+	}
+
+	// The steps of a foreach step read the item they run
+	if foreach, index, ok := repository.ParseItemStepName(step.Name); ok {
+		scope.index = index
+		items, err := foreachItems(scope.outputs[foreach+".items"])
+		if err == nil && index < len(items) {
+			scope.item = items[index]
+		}
 	}
 
 	inputs := make(map[string]interface{})
 
 	for arg, key := range step.Input {
-		isArgs := argsMatcher.MatchString(key)
-		existMapping := true
-		fmt.Println("inputs", arg, key, isArgs)
-		if isArgs {
-			argKey := strings.Replace(key, "$args.", "", 1)
-			result, ok := argsMap[argKey]
-			if !ok {
-				existMapping = false
-			} else {
-				inputs[arg] = result
-			}
-		} else {
-			result, ok := outputMap[key]
-			if !ok {
-				// Use hardcoded value
-				inputs[arg] = key
+		result, err := scope.resolveInput(key)
+		if err != nil {
+			msg := fmt.Sprintf("Input %s of step %s: %s", arg, step.Name, err)
+			run := h.startStepRun(ctx, state, stepState, inputs)
+			h.finishStepRun(ctx, run, repository.FAILED, errorResponse(msg))
+			var invalidReference *invalidReferenceError
+			if errors.As(err, &invalidReference) {
+				h.failStep(ctx, span, state, stepState, &repository.StepError{Code: "invalid_reference", Message: msg, Worker: "scheduler"})
 			} else {
-				inputs[arg] = result
+				h.failStep(ctx, span, state, stepState, msg)
 			}
-		}
-		if !existMapping {
-			state.Status = repository.FAILED
-			h.executionRepository.UpdateState(context.Background(), state)
-			log.Printf("Required output key not found: %s\n", key)
+			log.Printf("%s\n", msg)
 			span.RecordError(err)
 			return
 		}
+		inputs[arg] = result
+	}
+	// Steps of services over a concurrency limit wait in a queue until a step holding the limit finishes
+	if step.Service != "native" && !h.acquireConcurrency(ctx, span, state, stepState, config, message) {
+		return
 	}
-	fmt.Println("Found inputs", inputs)
+	run := h.startStepRun(ctx, state, stepState, inputs)
 	if step.Service == "native" {
 		h.HandleNativeStep(step, state, inputs, span, ctx)
+		// Steps that keep running finish their run later, foreach steps once their items finish
+		// and waiting steps when they wake up
+		keepsRunning := stepState.Status == repository.WAITING ||
+			(step.Task == "foreach" && stepState.Status != repository.FAILED)
+		if !keepsRunning {
+			h.finishStepRun(ctx, run, stepState.Status, nil)
+		}
 		return
 	}
 
+	if h.servicesWriters[config.Name] == nil {
+		// Nothing would ever answer the step, it fails like any other step so the failure handling runs
+		msg := fmt.Sprintf("Writer not found: %s", config.Name)
+		log.Printf("%s\n", msg)
+		span.RecordError(errors.New(msg))
+		h.releaseConcurrency(ctx, span, stepState)
+		h.finishStepRun(ctx, run, repository.FAILED, errorResponse(msg))
+		h.failStep(ctx, span, state, stepState, &repository.StepError{Code: "service_unavailable", Message: msg, Worker: "scheduler"})
+		return
+	}
+
+	// Each dispatch has its own ID, only the response that echoes the current one is handled
+	stepState.DispatchID = uuid.New().String()
+	span.SetAttributes(attribute.String("DispatchId", stepState.DispatchID))
 	serviceMessage := ServiceMessage{
 		ExecutionId: step.ExecutionID,
+		StepName:    step.Name,
 		TaskName:    step.Task,
 		Inputs:      inputs,
+		DispatchID:  stepState.DispatchID,
+		Attempt:     stepState.Attempt,
 	}
 
 	message, err = json.Marshal(serviceMessage)
@@ -259,22 +422,26 @@ func (h *Handler) HandleExecutionStep(message []byte, header []kafka.Header) {
 	}
 
 	log.Printf("Sending message: %s\n", message)
-	writer := h.servicesWriters[config.Name]
-	if writer == nil {
-		log.Printf("Writer not found: %s\n", config.Name)
-		return
+
+	stepState.Status = repository.EXECUTING
+	stepState.TimeoutAt = sql.NullTime{}
+	if step.TimeoutSeconds > 0 {
+		stepState.TimeoutAt = sql.NullTime{Time: time.Now().Add(time.Duration(step.TimeoutSeconds) * time.Second), Valid: true}
 	}
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	state.Status = repository.EXECUTING
+	h.executionRepository.UpdateState(context.Background(), state)
 
-	err = h.produceMessageFunction(writer, h.PassHeader(ctx), message)
+	// The message is published by the outbox relay once the state changes are committed
+	err = h.enqueue(ctx, config.Name, state.Priority, message)
 	if err != nil {
-		state.Status = repository.FAILED
-		h.executionRepository.UpdateState(context.Background(), state)
-		log.Printf("Failed to produce message: %s\n", err)
+		h.releaseConcurrency(ctx, span, stepState)
+		h.finishStepRun(ctx, run, repository.FAILED, errorResponse(fmt.Sprintf("Failed to enqueue message: %s", err)))
+		h.failStep(ctx, span, state, stepState, fmt.Sprintf("Failed to enqueue message: %s", err))
+		log.Printf("Failed to enqueue message: %s\n", err)
 		span.RecordError(err)
 		return
 	}
-	state.Status = repository.EXECUTING
-	h.executionRepository.UpdateState(context.Background(), state)
 }
 
 func (h *Handler) HandleNativeStep(
@@ -285,8 +452,14 @@ func (h *Handler) HandleNativeStep(
 	ctx context.Context,
 ) {
 	handlerMapper := map[string]nativeFn{
-		"abort": h.AbortHandler,
-		"if":    h.ConditionalHandler,
+		"abort":         h.AbortHandler,
+		"if":            h.ConditionalHandler,
+		"switch":        h.SwitchHandler,
+		"foreach":       h.ForeachHandler,
+		"sleep":         h.WaitHandler,
+		"waitUntil":     h.WaitHandler,
+		"waitForSignal": h.SignalHandler,
+		"subworkflow":   h.SubworkflowHandler,
 	}
 
 	handler, ok := handlerMapper[step.Task]
@@ -298,14 +471,15 @@ func (h *Handler) HandleNativeStep(
 
 type ServiceResponse struct {
 	ExecutionID uint                   `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	Outputs     map[string]interface{} `json:"outputs"`
 	TraceId     string                 `json:"traceId"`
+	DispatchID  string                 `json:"dispatchId"`
 }
 
 func (h *Handler) HandleServiceResponse(message []byte, header []kafka.Header) {
 	ctx, span := h.CreateOrGetSpan("HandleServiceResponse", header)
 	defer span.End()
-	fmt.Println("Received message from service", string(message))
 	response := ServiceResponse{}
 	err := json.Unmarshal(message, &response)
 	if err != nil {
@@ -321,63 +495,83 @@ func (h *Handler) HandleServiceResponse(message []byte, header []kafka.Header) {
 		return
 	}
 	state := execution.State
-	if state.Status != repository.EXECUTING {
-		log.Printf("Execution not executing: %s\n", state.Status)
-		span.RecordError(fmt.Errorf("execution not executing: %s", state.Status))
+	// Steps that were executing when the execution was paused are allowed to finish
+	if !state.IsActive() && state.Status != repository.PAUSED {
+		log.Printf("Execution not active: %s\n", state.Status)
+		span.RecordError(fmt.Errorf("execution not active: %s", state.Status))
 		return
 	}
+	stepState := respondingStepState(state, response.StepName)
+	if stepState == nil {
+		log.Printf("No executing step for response: %s\n", response.StepName)
+		span.RecordError(fmt.Errorf("no executing step for response: %s", response.StepName))
+		return
+	}
+	span.SetAttributes(attribute.String("Step", stepState.Name))
+	// Responses of previous dispatches of the step and duplicates of the handled one are dropped,
+	// so are responses without a dispatch once the step has one
+	if !h.executionRepository.ClaimStepDispatch(ctx, stepState.ID, response.DispatchID) {
+		log.Printf("Dropping stale or duplicate response of step %s: %s\n", stepState.Name, response.DispatchID)
+		span.AddEvent("DroppedResponse", trace.WithAttributes(attribute.String("DispatchId", response.DispatchID)))
+		return
+	}
+	stepState.DispatchID = ""
+	h.releaseConcurrency(ctx, span, stepState)
 	outputErr, ok := response.Outputs["error"]
+	runStatus := repository.SUCCESS
 	if ok {
-		execution.State.Status = repository.FAILED
-		fmt.Printf("Execution error: %s\n", reflect.TypeOf(outputErr))
-		errorMsg, ok := outputErr.(map[string]string)
-		if !ok {
-			errorMsg = map[string]string{
-				"msg": "Error message is not an object",
-			}
+		runStatus = repository.FAILED
+		stepErr := stepError(outputErr)
+		if _, isObject := outputErr.(map[string]interface{}); !isObject {
+			// Errors that come from a worker are its own even if they are only a message
+			stepErr = &repository.StepError{Code: "unknown", Message: stringValue(outputErr), Retryable: true}
 		}
-
-		str, err := json.Marshal(errorMsg)
-		if err != nil {
-			span.RecordError(err)
+		if step := execution.GetStep(stepState.Name); stepErr.Worker == "" && step != nil {
+			stepErr.Worker = step.Service
 		}
-		execution.State.Outputs = append(state.Outputs, &repository.KeyValueOutput{Key: "error", Value: string(str)})
-		h.executionRepository.UpdateState(context.Background(), execution.State)
-		log.Printf("Service failed: %s\n", response.Outputs["error"])
-		span.RecordError(err)
+		outputErr = stepErr
+	}
+	h.finishLatestStepRun(ctx, execution.ID, stepState.Name, runStatus, message)
+	if ok && h.retryStep(ctx, span, execution, stepState, outputErr) {
+		log.Printf("Step %s failed, retrying: %s\n", stepState.Name, stepError(outputErr).Message)
+		return
+	}
+	if ok {
+		log.Printf("Service failed: %s\n", stepError(outputErr).Message)
+		span.RecordError(fmt.Errorf("service failed: %s", stepError(outputErr).Message))
+		h.failStep(ctx, span, state, stepState, outputErr)
 		return
 	}
 	for k, v := range response.Outputs {
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{Key: fmt.Sprintf("%s.%s", state.Step, k), Value: v.(string)})
-	}
-	//Check if all steps are done
-	var nextStepIndex int
-	for _, step := range execution.Steps {
-		if step.Name == state.Step {
-			nextStepIndex = step.StepOrder + 1
-			break
-		}
+		h.setOutput(ctx, state, fmt.Sprintf("%s.%s", stepState.Name, k), v)
 	}
-	if nextStepIndex >= len(execution.Steps) {
-		state.Status = repository.SUCCESS
-		span.SetAttributes(attribute.Bool("Finished", true))
-	} else {
-		state.Step = execution.Steps[nextStepIndex].Name
-		state.Status = repository.PENDING
-		stepToExecute := execution.Steps[nextStepIndex].ToExecutionStepDTO()
-		h.executionRepository.UpdateState(context.Background(), state)
+	stepState.Status = repository.SUCCESS
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	if foreach, _, ok := repository.ParseItemStepName(stepState.Name); ok {
+		h.advanceExecution(ctx, span, state, h.continueForeach(ctx, span, execution, foreach))
+		return
+	}
+	h.advanceExecution(ctx, span, state, execution.ReadySteps(stepState.Name))
+}
 
-		//Enqueue the step
-		bytes, err := json.Marshal(stepToExecute)
-		if err != nil {
-			log.Printf("Failed to marshal message: %s\n", err)
-			// TODO manejar este caso
+// respondingStepState finds the executing step a service response belongs to.
+// Responses without a step name are matched only when a single step is executing
+func respondingStepState(state *repository.State, stepName string) *repository.StepState {
+	if stepName != "" {
+		stepState := state.GetStepState(stepName)
+		if stepState == nil || stepState.Status != repository.EXECUTING {
+			return nil
 		}
-		err = h.produceMessageFunction(h.executionStepsWriter, h.PassHeader(ctx), bytes)
-		if err != nil {
-			log.Printf("Failed to produce message: %s\n", err)
-			// TODO manejar este caso
+		return stepState
+	}
+	var executing *repository.StepState
+	for _, st := range state.StepStates {
+		if st.Status == repository.EXECUTING {
+			if executing != nil {
+				return nil
+			}
+			executing = st
 		}
 	}
-	h.executionRepository.UpdateState(context.Background(), state)
+	return executing
 }
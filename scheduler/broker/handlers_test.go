@@ -8,8 +8,10 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	trace2 "go.opentelemetry.io/otel/trace"
+	"reflect"
 	"scheduler/repository"
 	"testing"
+	"time"
 )
 
 type MockProducer struct {
@@ -32,18 +34,563 @@ func createSpan() (context.Context, trace2.Span) {
 	return tracer.Start(context.Background(), "test-span")
 }
 
-func TestHandler_EnqueueExecutionStep(t *testing.T) {
+func TestHandler_PublishOutboxMessage(t *testing.T) {
 	mockProducer := new(MockProducer)
+	stepsWriters := map[string]*kafka.Writer{
+		repository.HIGH_PRIORITY:   {Topic: "steps-high"},
+		repository.NORMAL_PRIORITY: {Topic: "steps"},
+	}
+	servicesWriters := map[string]map[string]*kafka.Writer{
+		"echo_service": {repository.HIGH_PRIORITY: {Topic: "echo_service_input-high"}},
+	}
 
-	h := NewHandler(nil, nil, nil, nil, createTracerProvider(), nil, mockProducer.ProduceMessage)
+	h := NewHandler(nil, nil, stepsWriters, servicesWriters, createTracerProvider(), nil, mockProducer.ProduceMessage)
 
-	step := repository.ExecutionStepDTO{}
-	ctx, span := createSpan()
-	msg, _ := json.Marshal(step)
-	mockProducer.On("ProduceMessage", h.executionStepsWriter, mock.Anything, msg).Return(nil)
+	msg, _ := json.Marshal(repository.ExecutionStepDTO{})
+	headers := []kafka.Header{{Key: "traceparent", Value: []byte("trace")}}
+	mockProducer.On("ProduceMessage", stepsWriters[repository.NORMAL_PRIORITY], headers, msg).Return(nil)
+	mockProducer.On("ProduceMessage", stepsWriters[repository.HIGH_PRIORITY], []kafka.Header{}, msg).Return(nil)
+	mockProducer.On("ProduceMessage", servicesWriters["echo_service"][repository.HIGH_PRIORITY], []kafka.Header{}, msg).Return(nil)
 
-	h.EnqueueExecutionStep(step, ctx, span)
+	messages := []*repository.OutboxMessage{
+		// Messages without priority are normal
+		{Headers: `{"traceparent":"trace"}`, Payload: string(msg)},
+		{Priority: repository.HIGH_PRIORITY, Payload: string(msg)},
+		{Destination: "echo_service", Priority: repository.HIGH_PRIORITY, Payload: string(msg)},
+		// Messages without writer are dropped
+		{Destination: "echo_service", Priority: repository.LOW_PRIORITY, Payload: string(msg)},
+		{Destination: "unknown", Payload: string(msg)},
+	}
+	for _, message := range messages {
+		err := h.publishOutboxMessage(message)
+		if err != nil {
+			t.Errorf("publishOutboxMessage() error = %v", err)
+		}
+	}
 
-	mockProducer.AssertCalled(t, "ProduceMessage", h.executionStepsWriter, mock.Anything, msg)
+	mockProducer.AssertNumberOfCalls(t, "ProduceMessage", 3)
 	mockProducer.AssertExpectations(t)
 }
+
+func TestRefreshStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		steps  []string
+		want   string
+	}{
+		{name: "Executing", status: repository.PENDING, steps: []string{repository.EXECUTING, repository.PENDING}, want: repository.EXECUTING},
+		{name: "Pending", status: repository.EXECUTING, steps: []string{repository.SUCCESS, repository.RETRYING}, want: repository.PENDING},
+		{name: "Success", status: repository.EXECUTING, steps: []string{repository.SUCCESS}, want: repository.SUCCESS},
+		{name: "Paused with active steps", status: repository.PAUSED, steps: []string{repository.EXECUTING}, want: repository.PAUSED},
+		{name: "Paused without active steps", status: repository.PAUSED, steps: []string{repository.SUCCESS}, want: repository.SUCCESS},
+		{name: "Waiting", status: repository.EXECUTING, steps: []string{repository.SUCCESS, repository.WAITING}, want: repository.WAITING},
+		{name: "Waiting and pending", status: repository.EXECUTING, steps: []string{repository.WAITING, repository.PENDING}, want: repository.PENDING},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &repository.State{Status: tt.status}
+			for _, status := range tt.steps {
+				state.StepStates = append(state.StepStates, &repository.StepState{Status: status})
+			}
+			refreshStatus(state)
+			if state.Status != tt.want {
+				t.Errorf("refreshStatus() = %v, want %v", state.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestStepError(t *testing.T) {
+	tests := []struct {
+		name      string
+		outputErr interface{}
+		want      *repository.StepError
+	}{
+		{
+			name:      "Envelope",
+			outputErr: map[string]interface{}{"code": "invalid_input", "message": "cmd is required", "retryable": false, "worker": "ubuntu_service", "details": map[string]interface{}{"input": "cmd"}},
+			want:      &repository.StepError{Code: "invalid_input", Message: "cmd is required", Retryable: false, Worker: "ubuntu_service", Details: map[string]interface{}{"input": "cmd"}},
+		},
+		{
+			name:      "Legacy msg",
+			outputErr: map[string]interface{}{"msg": "failed", "code": "network"},
+			want:      &repository.StepError{Code: "network", Message: "failed", Retryable: true},
+		},
+		{
+			name:      "Without code",
+			outputErr: map[string]interface{}{"msg": "failed"},
+			want:      &repository.StepError{Code: "unknown", Message: "failed", Retryable: true},
+		},
+		{
+			name:      "Scheduler",
+			outputErr: "Path end is not found",
+			want:      &repository.StepError{Code: "scheduler", Message: "Path end is not found", Worker: "scheduler"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stepError(tt.outputErr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stepError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForeachItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    []interface{}
+		wantErr bool
+	}{
+		{name: "Argument", value: []interface{}{"a", "b"}, want: []interface{}{"a", "b"}},
+		{name: "Output", value: `["a", {"key": "b"}]`, want: []interface{}{"a", map[string]interface{}{"key": "b"}}},
+		{name: "Not an array", value: `{"key": "b"}`, wantErr: true},
+		{name: "Missing", value: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := foreachItems(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("foreachItems() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("foreachItems() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForeachConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    int
+		wantErr bool
+	}{
+		{name: "Missing", value: nil, want: 0},
+		{name: "String", value: "3", want: 3},
+		{name: "Number", value: float64(2), want: 2},
+		{name: "Negative", value: "-1", wantErr: true},
+		{name: "Not a number", value: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := foreachConcurrency(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("foreachConcurrency() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("foreachConcurrency() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitDuration(t *testing.T) {
+	now := time.Date(2024, 11, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		task    string
+		inputs  map[string]interface{}
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "Sleep seconds", task: "sleep", inputs: map[string]interface{}{"seconds": "600"}, want: 10 * time.Minute},
+		{name: "Sleep number", task: "sleep", inputs: map[string]interface{}{"seconds": float64(1.5)}, want: 1500 * time.Millisecond},
+		{name: "Sleep negative", task: "sleep", inputs: map[string]interface{}{"seconds": "-1"}, wantErr: true},
+		{name: "Sleep missing", task: "sleep", inputs: map[string]interface{}{}, wantErr: true},
+		{name: "Wait until", task: "waitUntil", inputs: map[string]interface{}{"until": "2024-11-20T10:05:00Z"}, want: 5 * time.Minute},
+		{name: "Wait until past", task: "waitUntil", inputs: map[string]interface{}{"until": "2024-11-20T09:00:00Z"}, want: 0},
+		{name: "Wait until invalid", task: "waitUntil", inputs: map[string]interface{}{"until": "tomorrow"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := waitDuration(tt.task, tt.inputs, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitDuration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("waitDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "String", value: "approved", want: "approved"},
+		{name: "Bool", value: true, want: "true"},
+		{name: "Object", value: map[string]interface{}{"by": "ops"}, want: `{"by":"ops"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outputValue(tt.value); got != tt.want {
+				t.Errorf("outputValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubworkflowArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "Missing", value: nil, want: map[string]string{}},
+		{name: "Object", value: map[string]interface{}{"bucket": "files", "retries": float64(2)}, want: map[string]string{"bucket": "files", "retries": "2"}},
+		{name: "JSON", value: `{"bucket": "files"}`, want: map[string]string{"bucket": "files"}},
+		{name: "Not an object", value: `["files"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := subworkflowArguments(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("subworkflowArguments() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subworkflowArguments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveInput(t *testing.T) {
+	scope := &expressionScope{
+		args: map[string]interface{}{"n": float64(3), "name": "report", "files": []interface{}{"a.txt", "b.txt"}},
+		outputs: map[string]interface{}{
+			"download.path":  "/tmp/report.csv",
+			"download.count": "4",
+			"parse.result":   `{"rows": [{"id": 7}], "ok": true}`,
+			"list.files":     []interface{}{map[string]interface{}{"name": "a.txt", "size": float64(2)}},
+		},
+		error:     map[string]interface{}{},
+		item:      map[string]interface{}{"key": "a.txt"},
+		index:     1,
+		stepNames: func() []string { return []string{"download", "parse", "list", "items"} },
+	}
+	tests := []struct {
+		name    string
+		input   string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "Literal", input: "ls -la", want: "ls -la"},
+		{name: "Legacy args", input: "$args.name", want: "report"},
+		{name: "Legacy output key", input: "download.path", want: "/tmp/report.csv"},
+		{name: "Legacy missing args", input: "$args.missing", wantErr: "required argument not found: $args.missing"},
+		{name: "Legacy missing output key", input: "download.size", wantErr: "invalid reference download.size, the step has no such output"},
+		{name: "Legacy missing item output key", input: "items[0].size", wantErr: "invalid reference items[0].size, the step has no such output"},
+		{name: "Literal with a dot", input: "report.csv", want: "report.csv"},
+		{name: "Step output", input: "${{ steps.download.outputs.path }}", want: "/tmp/report.csv"},
+		{name: "Template", input: "cat ${{ steps.download.outputs.path }} > ${{ args.name }}.out", want: "cat /tmp/report.csv > report.out"},
+		{name: "Math", input: "${{ args.n * 2 + 1 }}", want: float64(7)},
+		{name: "Numeric output", input: "${{ steps.download.outputs.count / 2 }}", want: float64(2)},
+		{name: "Parentheses", input: "${{ (args.n + 1) % 3 }}", want: float64(1)},
+		{name: "String concatenation", input: "${{ args.name + '.csv' }}", want: "report.csv"},
+		{name: "JSON path", input: "${{ steps.parse.outputs.result.rows[0].id }}", want: float64(7)},
+		{name: "Array index", input: "${{ args.files[1] }}", want: "b.txt"},
+		{name: "Structured output", input: "${{ steps.list.outputs.files[0].size * 2 }}", want: float64(4)},
+		{name: "Legacy structured output", input: "list.files", want: []interface{}{map[string]interface{}{"name": "a.txt", "size": float64(2)}}},
+		{name: "Bracket field", input: "${{ steps['download'].outputs['path'] }}", want: "/tmp/report.csv"},
+		{name: "Item and index", input: "${{ item.key }}-${{ index }}", want: "a.txt-1"},
+		{name: "Functions", input: "${{ upper(replace(args.name, 'port', 'ad')) }}", want: "READ"},
+		{name: "Join and length", input: "${{ join(args.files, ',') }} ${{ length(args.files) }}", want: "a.txt,b.txt 2"},
+		{name: "Default of missing", input: "${{ default(args.missing, 'none') }}", want: "none"},
+		{name: "Default of present", input: "${{ default(args.name, 'none') }}", want: "report"},
+		{name: "Escaped", input: "echo $${{ args.name }}", want: "echo ${{ args.name }}"},
+		{name: "Missing output", input: "${{ steps.downlaod.outputs.path }}", wantErr: "steps.downlaod is not defined"},
+		{name: "Missing field", input: "${{ steps.parse.outputs.result.rows[3] }}", wantErr: "steps.parse.outputs.result.rows[3] is not defined"},
+		{name: "Missing error", input: "${{ error.msg }}", wantErr: "error is not defined"},
+		{name: "Unknown reference", input: "${{ arg.name }}", wantErr: "unknown reference arg"},
+		{name: "Unknown function", input: "${{ shout(args.name) }}", wantErr: "unknown function shout"},
+		{name: "Not a number", input: "${{ args.name * 2 }}", wantErr: "report * 2 needs two numbers"},
+		{name: "Invalid expression", input: "${{ args.n * }}", wantErr: `invalid expression "args.n *": unexpected end`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scope.resolveInput(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("resolveInput() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveInput() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveInput() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		left     interface{}
+		operator string
+		right    interface{}
+		want     bool
+		wantErr  bool
+	}{
+		{name: "Equal numbers as strings", left: "0", operator: "==", right: float64(0), want: true},
+		{name: "Equal texts", left: "done", operator: "==", right: "done", want: true},
+		{name: "Not equal", left: "1", operator: "!=", right: float64(0), want: true},
+		{name: "Not equal same value", left: "0", operator: "!=", right: float64(0), want: false},
+		{name: "Numeric less than", left: "9", operator: "<", right: "10", want: true},
+		{name: "Numeric greater or equal", left: float64(10), operator: ">=", right: "10", want: true},
+		{name: "Text order", left: "2024-01-01", operator: "<", right: "2024-02-01", want: true},
+		{name: "Number and text order", left: float64(1), operator: ">", right: "many", wantErr: true},
+		{name: "Contains text", left: "file.csv", operator: "contains", right: ".csv", want: true},
+		{name: "Contains JSON array", left: `["a", "b"]`, operator: "contains", right: "b", want: true},
+		{name: "Contains object key", left: map[string]interface{}{"a": 1.0}, operator: "contains", right: "b", want: false},
+		{name: "In", left: "2", operator: "in", right: []interface{}{1.0, 2.0}, want: true},
+		{name: "Starts with", left: "s3://bucket/key", operator: "startsWith", right: "s3://", want: true},
+		{name: "Matches", left: "report-2024.csv", operator: "matches", right: `^report-\d+\.csv$`, want: true},
+		{name: "Invalid regex", left: "a", operator: "matches", right: "(", wantErr: true},
+		{name: "Empty text", left: " ", operator: "isEmpty", want: true},
+		{name: "Empty JSON array", left: "[]", operator: "isEmpty", want: true},
+		{name: "Not empty", left: "0", operator: "isEmpty", want: false},
+		{name: "Invalid operator", left: "a", operator: "=~", right: "a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := compareValues(tt.left, tt.operator, tt.right)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compareValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("compareValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionEvaluate(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions string
+		or         bool
+		want       bool
+		wantErr    bool
+	}{
+		{name: "And", conditions: `[{"leftValue": "0", "operator": "==", "rightValue": 0}, {"leftValue": "3", "operator": ">", "rightValue": 2}]`, want: true},
+		{name: "And with false", conditions: `[{"leftValue": "0", "operator": "==", "rightValue": 0}, {"leftValue": "3", "operator": ">", "rightValue": 5}]`, want: false},
+		{name: "Or", conditions: `[{"leftValue": "", "operator": "isEmpty"}, {"leftValue": "a", "operator": "==", "rightValue": "b"}]`, or: true, want: true},
+		{name: "Nested", conditions: `[{"and": [{"leftValue": 1, "operator": "<", "rightValue": 2}]}, {"leftValue": "a", "operator": "==", "rightValue": "b"}]`, or: true, want: true},
+		{name: "Invalid operator", conditions: `[{"leftValue": 1, "operator": "~", "rightValue": 2}]`, wantErr: true},
+		{name: "Not an array", conditions: `{"leftValue": 1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions, err := parseConditions(tt.conditions)
+			cond := condition{And: conditions}
+			if tt.or {
+				cond = condition{Or: conditions}
+			}
+			got := false
+			if err == nil {
+				got, err = cond.evaluate()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("evaluate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCase(t *testing.T) {
+	cases := `[
+		{"value": 0, "next": "success"},
+		{"value": 1, "next": "warning"},
+		{"operator": ">", "value": 100, "next": "fatal"},
+		{"operator": "in", "value": [2, 3], "next": "retry"}
+	]`
+	tests := []struct {
+		name  string
+		value interface{}
+		want  int
+	}{
+		{name: "First case", value: "0", want: 0},
+		{name: "Second case", value: float64(1), want: 1},
+		{name: "Operator", value: "127", want: 2},
+		{name: "In", value: "3", want: 3},
+		{name: "Default", value: "42", want: -1},
+	}
+	parsed, err := parseCases(cases)
+	if err != nil {
+		t.Fatalf("parseCases() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchCase(tt.value, parsed)
+			if err != nil {
+				t.Fatalf("matchCase() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("matchCase() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := parseCases(`[{"value": 0}]`); err == nil {
+		t.Errorf("parseCases() accepted a case without next step")
+	}
+}
+
+func TestKeptSteps(t *testing.T) {
+	dependsOn := func(names ...string) []*repository.StepDependency {
+		dependencies := make([]*repository.StepDependency, 0)
+		for _, name := range names {
+			dependencies = append(dependencies, &repository.StepDependency{DependsOn: name})
+		}
+		return dependencies
+	}
+	// a and b join in c, check branches to ok or ko, cleanup runs on failure
+	execution := &repository.Execution{
+		Steps: []*repository.Step{
+			{Name: "a"},
+			{Name: "b"},
+			{Name: "c", Dependencies: dependsOn("a", "b")},
+			{Name: "check", Service: "native", Task: "if", Inputs: []*repository.KeyValueStep{
+				{Key: "onTrue", Value: "ok"},
+				{Key: "onFalse", Value: "ko"},
+			}},
+			{Name: "ok"},
+			{Name: "ko"},
+			{Name: "items", Service: "native", Task: "foreach"},
+			{Name: "items:template", Foreach: "items"},
+			{Name: "cleanup", Phase: repository.ON_FAILURE},
+		},
+	}
+	tests := []struct {
+		name   string
+		states map[string]string
+		want   map[string]bool
+	}{
+		{
+			name:   "Join after a failed parent",
+			states: map[string]string{"a": repository.FAILED, "b": repository.SUCCESS, "c": repository.SUCCESS, "cleanup": repository.SUCCESS},
+			want:   map[string]bool{"b": true},
+		},
+		{
+			name:   "Path of a failed branch",
+			states: map[string]string{"check": repository.FAILED, "ok": repository.SUCCESS},
+			want:   map[string]bool{},
+		},
+		{
+			name:   "Path of a kept branch",
+			states: map[string]string{"check": repository.SUCCESS, "ok": repository.SUCCESS},
+			want:   map[string]bool{"check": true, "ok": true},
+		},
+		{
+			name:   "Items of a failed foreach",
+			states: map[string]string{"items": repository.EXECUTING, "items[0]": repository.SUCCESS, "items[1]": repository.FAILED},
+			want:   map[string]bool{"items[0]": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execution.State = &repository.State{}
+			for name, status := range tt.states {
+				execution.State.StepStates = append(execution.State.StepStates, &repository.StepState{Name: name, Status: status})
+			}
+			if got := keptSteps(execution); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keptSteps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkippedPaths(t *testing.T) {
+	dependsOn := func(names ...string) []*repository.StepDependency {
+		dependencies := make([]*repository.StepDependency, 0)
+		for _, name := range names {
+			dependencies = append(dependencies, &repository.StepDependency{DependsOn: name})
+		}
+		return dependencies
+	}
+	branch := func(onTrue string, onFalse string) *repository.Step {
+		return &repository.Step{Name: "check", Service: "native", Task: "if", Inputs: []*repository.KeyValueStep{
+			{Key: "onTrue", Value: onTrue},
+			{Key: "onFalse", Value: onFalse},
+		}}
+	}
+	tests := []struct {
+		name   string
+		steps  []*repository.Step
+		states map[string]string
+		chosen string
+		want   []string
+	}{
+		{
+			name: "Join of both paths",
+			steps: []*repository.Step{
+				branch("ok", "ko"),
+				{Name: "ok", Dependencies: dependsOn("check")},
+				{Name: "ko", Dependencies: dependsOn("check")},
+				{Name: "ko-notify", Dependencies: dependsOn("ko")},
+				{Name: "join", Dependencies: dependsOn("ok", "ko-notify")},
+			},
+			chosen: "ok",
+			want:   []string{"ko", "ko-notify"},
+		},
+		{
+			name: "Jump over linear steps",
+			steps: []*repository.Step{
+				branch("first", "third"),
+				{Name: "first", Dependencies: dependsOn("check")},
+				{Name: "second", Dependencies: dependsOn("first")},
+				{Name: "third", Dependencies: dependsOn("second")},
+			},
+			chosen: "third",
+			want:   []string{"first", "second"},
+		},
+		{
+			name: "Path that leads to the other one",
+			steps: []*repository.Step{
+				branch("first", "third"),
+				{Name: "first", Dependencies: dependsOn("check")},
+				{Name: "second", Dependencies: dependsOn("first")},
+				{Name: "third", Dependencies: dependsOn("second")},
+			},
+			chosen: "first",
+			want:   []string{},
+		},
+		{
+			name: "Steps that already ran",
+			steps: []*repository.Step{
+				branch("ok", "ko"),
+				{Name: "ok", Dependencies: dependsOn("check")},
+				{Name: "ko", Dependencies: dependsOn("check")},
+			},
+			states: map[string]string{"ko": repository.SUCCESS},
+			chosen: "ok",
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execution := &repository.Execution{Steps: tt.steps, State: &repository.State{}}
+			execution.State.StepStates = append(execution.State.StepStates, &repository.StepState{Name: "check", Status: repository.SUCCESS})
+			for name, status := range tt.states {
+				execution.State.StepStates = append(execution.State.StepStates, &repository.StepState{Name: name, Status: status})
+			}
+			got := skippedPaths(execution, execution.GetStep("check"), []*repository.Step{execution.GetStep(tt.chosen)})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("skippedPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,10 @@ package broker
 import (
 	"context"
 	"fmt"
-	"log"
 	"scheduler/repository"
+	"slices"
 	"strings"
 
-	"github.com/goccy/go-json"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -19,7 +18,8 @@ type nativeFn func(
 	ctx context.Context,
 )
 
-// TODO: Unit Test? | Integration Test?
+// ConditionalHandler continues with the onTrue or the onFalse step depending on the condition. The condition compares
+// leftValue and rightValue with the operator, or is the and/or composition of a list of conditions
 func (h *Handler) ConditionalHandler(
 	step repository.ExecutionStepDTO,
 	state *repository.State,
@@ -28,11 +28,21 @@ func (h *Handler) ConditionalHandler(
 	ctx context.Context,
 ) {
 	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	stepState := state.GetStepState(step.Name)
+	onTruePath, onTrueOk := inputs["onTrue"]
+	onFalsePath, onFalseOk := inputs["onFalse"]
+	andConditions, andOk := inputs["and"]
+	orConditions, orOk := inputs["or"]
 	leftValue, leftOk := inputs["leftValue"]
 	rightValue, rightOk := inputs["rightValue"]
 	operator, opOk := inputs["operator"]
-	onTruePath, onTrueOk := inputs["onTrue"]
-	onFalsePath, onFalseOk := inputs["onFalse"]
+	if andOk || orOk {
+		// The composition replaces the comparison
+		leftOk, rightOk, opOk = true, true, true
+	} else if operator == "isEmpty" {
+		rightOk = true
+	}
 
 	values := [...]bool{leftOk, rightOk, opOk, onTrueOk, onFalseOk}
 	valuesName := [...]string{"leftValue", "rightValue", "operator", "onTrue", "onFalse"}
@@ -44,104 +54,207 @@ func (h *Handler) ConditionalHandler(
 		}
 	}
 	if len(failed) > 0 {
-		state.Status = repository.FAILED
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-			Key:   "error",
-			Value: fmt.Sprintf("Following required properties are not specified %s", strings.Join(failed, ",")),
-		})
-		h.executionRepository.UpdateState(context.Background(), state)
+		h.failStep(ctx, span, state, stepState, fmt.Sprintf("Following required properties are not specified %s", strings.Join(failed, ",")))
 		return
 	}
 
 	// Evaluate condition
-	var evalPath string
-	var evalResult bool
-	if operator == "==" {
-		evalResult = leftValue == rightValue
-		if evalResult {
-			evalPath = onTruePath.(string)
-		} else {
-			evalPath = onFalsePath.(string)
-		}
-	} else if operator == "!=" {
-		evalResult = leftValue != rightValue
-		if evalResult {
-			evalPath = onFalsePath.(string)
-		} else {
-			evalPath = onTruePath.(string)
+	cond := condition{LeftValue: leftValue, Operator: stringValue(operator), RightValue: rightValue}
+	var err error
+	if andOk {
+		cond = condition{}
+		cond.And, err = parseConditions(andConditions)
+	} else if orOk {
+		cond = condition{}
+		cond.Or, err = parseConditions(orConditions)
+	}
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	evalResult, err := cond.evaluate()
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	evalPath := stringValue(onFalsePath)
+	if evalResult {
+		evalPath = stringValue(onTruePath)
+	}
+
+	h.followPath(ctx, span, execution, stepState, evalPath, evalResult)
+}
+
+// SwitchHandler continues with the next step of the first case that matches the value,
+// or with the default step if none does
+func (h *Handler) SwitchHandler(
+	step repository.ExecutionStepDTO,
+	state *repository.State,
+	inputs map[string]interface{},
+	span trace.Span,
+	ctx context.Context,
+) {
+	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	stepState := state.GetStepState(step.Name)
+	value, valueOk := inputs["value"]
+	casesInput, casesOk := inputs["cases"]
+	defaultPath, defaultOk := inputs["default"]
+
+	values := [...]bool{valueOk, casesOk, defaultOk}
+	valuesName := [...]string{"value", "cases", "default"}
+
+	failed := make([]string, 0)
+	for i, ok := range values {
+		if !ok {
+			failed = append(failed, valuesName[i])
 		}
-	} else {
-		state.Status = repository.FAILED
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-			Key:   "error",
-			Value: fmt.Sprintf("%s is not a valid operator", operator),
-		})
-		h.executionRepository.UpdateState(context.Background(), state)
+	}
+	if len(failed) > 0 {
+		h.failStep(ctx, span, state, stepState, fmt.Sprintf("Following required properties are not specified %s", strings.Join(failed, ",")))
+		return
+	}
+
+	cases, err := parseCases(casesInput)
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	index, err := matchCase(value, cases)
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
 		return
 	}
+	if index < 0 {
+		h.followPath(ctx, span, execution, stepState, stringValue(defaultPath), "default")
+		return
+	}
+	h.followPath(ctx, span, execution, stepState, cases[index].Next, index)
+}
 
-	steps := execution.Steps
-	var currentStep *repository.Step
-	var nextStep *repository.Step
-	var inmediateNextStep *repository.Step
-	for _, value := range steps {
-		if evalPath == value.Name {
-			nextStep = value
+// followPath finishes a branching step and dispatches the step of the chosen path,
+// continue dispatches the steps that depend on the branching step instead. The paths that were not taken are skipped,
+// the chosen steps wait like any other step for the rest of their dependencies
+func (h *Handler) followPath(
+	ctx context.Context,
+	span trace.Span,
+	execution *repository.Execution,
+	stepState *repository.StepState,
+	path string,
+	result interface{},
+) {
+	state := execution.State
+	var chosen []*repository.Step
+	if path != "continue" {
+		nextStep := execution.GetStep(path)
+		if nextStep == nil {
+			// No found path
+			h.failStep(ctx, span, state, stepState, fmt.Sprintf("Path %s is not found", path))
+			return
 		}
-		if currentStep != nil {
-			inmediateNextStep = value
+		chosen = []*repository.Step{nextStep}
+	}
+
+	stepState.Status = repository.SUCCESS
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	if path == "continue" {
+		// Continue with the steps that depend on this one, if there are none the execution ends
+		chosen = execution.ReadySteps(stepState.Name)
+	}
+	h.setOutput(ctx, state, stepState.Name+".result", result)
+
+	skipped := skippedPaths(execution, execution.GetStep(stepState.Name), chosen)
+	for _, name := range skipped {
+		skippedState := &repository.StepState{StateID: state.ID, Name: name, Status: repository.SKIPPED}
+		state.StepStates = append(state.StepStates, skippedState)
+		h.executionRepository.UpdateStepState(ctx, skippedState)
+	}
+	nextSteps := make([]*repository.Step, 0)
+	for _, step := range chosen {
+		if execution.DependenciesDone(step) {
+			nextSteps = append(nextSteps, step)
 		}
-		if value.Name == step.Name {
-			currentStep = value
+	}
+	// Joins that were only waiting for a skipped path go on
+	for _, name := range skipped {
+		for _, step := range execution.ReadySteps(name) {
+			if !slices.Contains(nextSteps, step) {
+				nextSteps = append(nextSteps, step)
+			}
 		}
 	}
+	h.advanceExecution(ctx, span, state, nextSteps)
+}
 
-	if evalPath == "continue" {
-		nextStep = inmediateNextStep
-	} else if nextStep == nil {
-		// No found path
-		state.Status = repository.FAILED
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-			Key:   "error",
-			Value: fmt.Sprintf("Path %s is not found", evalPath),
-		})
-		h.executionRepository.UpdateState(context.Background(), state)
-		return
+// branchPaths returns the steps an if or a switch step can choose, none for the rest of the steps
+func branchPaths(step *repository.Step) []string {
+	if step.Service != "native" || (step.Task != "if" && step.Task != "switch") {
+		return nil
 	}
+	paths := []string{step.GetInput("onTrue"), step.GetInput("onFalse"), step.GetInput("default")}
+	if cases, err := parseCases(step.GetInput("cases")); err == nil {
+		for _, c := range cases {
+			paths = append(paths, c.Next)
+		}
+	}
+	return paths
+}
 
-	// Got to end of steps
-	if nextStep == nil {
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-			Key:   step.Name + ".result",
-			Value: fmt.Sprintf("%t", evalResult),
-		})
-		state.Status = repository.SUCCESS
-	} else {
-		stepToExecute := nextStep.ToExecutionStepDTO()
-
-		//Enqueue the step
-		bytes, err := json.Marshal(stepToExecute)
-		if err != nil {
-			log.Printf("Failed to marshal message: %s\n", err)
-			span.RecordError(err)
-			state.Status = repository.FAILED
-			h.executionRepository.UpdateState(context.Background(), state)
-			return
+// skippedPaths returns the steps that the branching step leaves out by taking the chosen steps: its other paths and the
+// steps that depend on it, then the steps whose dependencies are all skipped. The chosen steps and the steps after them
+// are never skipped, so a path that leads to another one keeps it, nor are the steps that already ran
+func skippedPaths(execution *repository.Execution, branch *repository.Step, chosen []*repository.Step) []string {
+	// Steps reached from the chosen ones
+	reached := make(map[string]bool)
+	for _, step := range chosen {
+		reached[step.Name] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range execution.Steps {
+			if reached[s.Name] {
+				continue
+			}
+			for _, d := range s.Dependencies {
+				if reached[d.DependsOn] {
+					reached[s.Name] = true
+					changed = true
+					break
+				}
+			}
 		}
-		err = ProduceMessage(h.executionStepsWriter, h.PassHeader(ctx), bytes)
-		if err != nil {
-			log.Printf("Failed to produce message: %s\n", err)
-			state.Status = repository.FAILED
-			h.executionRepository.UpdateState(context.Background(), state)
-			return
+	}
+	skippable := func(s *repository.Step) bool {
+		return s.Phase == branch.Phase && s.Foreach == "" && !reached[s.Name] && execution.State.GetStepState(s.Name) == nil
+	}
+	skipped := make([]string, 0)
+	paths := branchPaths(branch)
+	for _, s := range execution.Steps {
+		if skippable(s) && (slices.Contains(paths, s.Name) || s.DependsOn(branch.Name)) {
+			skipped = append(skipped, s.Name)
+		}
+	}
+	// The steps that only depend on skipped steps are skipped too
+	for changed := true; changed; {
+		changed = false
+		for _, s := range execution.Steps {
+			if !skippable(s) || len(s.Dependencies) == 0 || slices.Contains(skipped, s.Name) {
+				continue
+			}
+			allSkipped := true
+			for _, d := range s.Dependencies {
+				if !slices.Contains(skipped, d.DependsOn) {
+					allSkipped = false
+					break
+				}
+			}
+			if allSkipped {
+				skipped = append(skipped, s.Name)
+				changed = true
+			}
 		}
-		state.Step = nextStep.Name
-		state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-			Key:   step.Name + ".result",
-			Value: fmt.Sprintf("%t", evalResult),
-		})
 	}
-	h.executionRepository.UpdateState(context.Background(), state)
+	return skipped
 }
 
 func (h *Handler) AbortHandler(
@@ -151,8 +264,12 @@ func (h *Handler) AbortHandler(
 	span trace.Span,
 	ctx context.Context,
 ) {
-	state.Status = repository.SUCCESS
-	h.executionRepository.UpdateState(context.Background(), state)
+	stepState := state.GetStepState(step.Name)
+	stepState.Status = repository.SUCCESS
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	// The rest of the current phase is skipped, the finally steps still run
+	h.cancelActiveSteps(ctx, state)
+	h.completePhase(ctx, span, state)
 }
 
 func (h *Handler) ErrorHandler(
@@ -162,10 +279,5 @@ func (h *Handler) ErrorHandler(
 	span trace.Span,
 	ctx context.Context,
 ) {
-	state.Status = repository.FAILED
-	state.Outputs = append(state.Outputs, &repository.KeyValueOutput{
-		Key:   "error",
-		Value: fmt.Sprintf("%s is not a valid native taskname", step.Task),
-	})
-	h.executionRepository.UpdateState(context.Background(), state)
+	h.failStep(ctx, span, state, state.GetStepState(step.Name), fmt.Sprintf("%s is not a valid native taskname", step.Task))
 }
@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"time"
+
+	"github.com/goccy/go-json"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const (
+	outboxBatchSize = 100
+	// transactionAttempts is how many times a handler runs when its transaction fails,
+	// like on a deadlock or when another writer updated the state it loaded
+	transactionAttempts = 5
+)
+
+// Transactional runs a message handler in a transaction, the state changes it makes and the messages it enqueues
+// are committed together
+func (h *Handler) Transactional(handler func(h *Handler, message []byte, header []kafka.Header)) func([]byte, []kafka.Header) {
+	return func(message []byte, header []kafka.Header) {
+		h.InTransaction(context.Background(), func(tx *Handler) error {
+			handler(tx, message, header)
+			return nil
+		})
+	}
+}
+
+// InTransaction runs fn with a handler whose repository changes are committed together once it returns,
+// they are rolled back if fn returns an error. fn runs again if the transaction fails and reloads what it reads,
+// the relay is woken up to publish the messages it enqueued
+func (h *Handler) InTransaction(ctx context.Context, fn func(tx *Handler) error) error {
+	base := h.outside()
+	var err error
+	for attempt := 1; attempt <= transactionAttempts; attempt++ {
+		var fnErr error
+		err = base.executionRepository.Transaction(ctx, func(repository *repository.ExecutionRepository) error {
+			tx := *base
+			tx.executionRepository = repository
+			tx.base = base
+			fnErr = fn(&tx)
+			return fnErr
+		})
+		if err == nil {
+			base.notifyOutbox()
+			return nil
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+		if errors.Is(err, repository.ErrConflict) {
+			log.Printf("Retrying transaction after conflict on attempt %d\n", attempt)
+			continue
+		}
+		log.Printf("Transaction failed on attempt %d: %s\n", attempt, err)
+	}
+	log.Printf("Giving up on transaction: %s\n", err)
+	return err
+}
+
+// outside returns the handler that is not bound to a transaction, for work that runs after the transaction ends
+func (h *Handler) outside() *Handler {
+	if h.base != nil {
+		return h.base
+	}
+	return h
+}
+
+// enqueue adds a message to the outbox, it is published to the steps topic or to the input topic of the service
+// of the given priority
+func (h *Handler) enqueue(ctx context.Context, destination string, priority string, message []byte) error {
+	headers := make(map[string]string)
+	for _, header := range h.PassHeader(ctx) {
+		headers[header.Key] = string(header.Value)
+	}
+	bytes, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	err = h.executionRepository.AddOutboxMessage(ctx, &repository.OutboxMessage{
+		Destination: destination,
+		Priority:    priority,
+		Headers:     string(bytes),
+		Payload:     string(message),
+	})
+	if err != nil {
+		return err
+	}
+	h.notifyOutbox()
+	return nil
+}
+
+// notifyOutbox wakes up the relay without waiting for it
+func (h *Handler) notifyOutbox() {
+	select {
+	case h.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// RunOutboxRelay publishes the messages of the outbox until the context is done, every interval and whenever
+// messages are enqueued. Every instance runs it, a message is published at least once
+func (h *Handler) RunOutboxRelay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for h.relayOutbox(ctx) == outboxBatchSize {
+		}
+		select {
+		case <-ctx.Done():
+			// The messages enqueued until then are published before it stops
+			for h.relayOutbox(context.Background()) == outboxBatchSize {
+			}
+			return
+		case <-ticker.C:
+		case <-h.outboxReady:
+		}
+	}
+}
+
+func (h *Handler) relayOutbox(ctx context.Context) int {
+	published, err := h.executionRepository.PublishOutbox(ctx, outboxBatchSize, h.publishOutboxMessage)
+	if err != nil {
+		log.Printf("Failed to relay outbox: %s\n", err)
+	}
+	return published
+}
+
+// publishOutboxMessage produces a message of the outbox on the topic of its priority,
+// messages for services without writer are dropped
+func (h *Handler) publishOutboxMessage(message *repository.OutboxMessage) error {
+	priority := message.Priority
+	if priority == "" {
+		priority = repository.NORMAL_PRIORITY
+	}
+	writers := h.executionStepsWriters
+	if message.Destination != "" {
+		writers = h.servicesWriters[message.Destination]
+	}
+	writer := writers[priority]
+	if writer == nil {
+		log.Printf("Dropping outbox message %d, writer not found: %s %s\n", message.ID, message.Destination, priority)
+		return nil
+	}
+	headerMap := make(map[string]string)
+	if message.Headers != "" {
+		err := json.Unmarshal([]byte(message.Headers), &headerMap)
+		if err != nil {
+			return fmt.Errorf("invalid headers: %s", err)
+		}
+	}
+	headers := make([]kafka.Header, 0, len(headerMap))
+	for key, value := range headerMap {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return h.produceMessageFunction(writer, headers, []byte(message.Payload))
+}
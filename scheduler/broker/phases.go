@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"context"
+	"scheduler/repository"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// continueWithPhases starts the first of the given phases that has steps,
+// the execution ends with its outcome when none of them has
+func (h *Handler) continueWithPhases(ctx context.Context, span trace.Span, state *repository.State, phases ...string) {
+	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	for _, phase := range phases {
+		roots := execution.PhaseRootSteps(phase)
+		if len(roots) == 0 {
+			continue
+		}
+		state.Phase = phase
+		// The execution has to be active before the steps are handled, a paused one holds them
+		if state.Status != repository.PAUSED {
+			state.Status = repository.PENDING
+		}
+		h.executionRepository.UpdateState(context.Background(), state)
+		h.advanceExecution(ctx, span, state, roots)
+		return
+	}
+	state.Status = state.Outcome
+	if state.Status == repository.SUCCESS {
+		span.SetAttributes(attribute.Bool("Finished", true))
+	}
+	h.executionRepository.UpdateState(context.Background(), state)
+	if execution.ParentExecutionID != 0 {
+		h.finishSubworkflow(ctx, span, execution)
+	}
+}
+
+// completePhase moves the execution past the phase whose steps finished,
+// the execution succeeds when the steps of the workflow finish
+func (h *Handler) completePhase(ctx context.Context, span trace.Span, state *repository.State) {
+	switch state.Phase {
+	case repository.ON_FAILURE:
+		h.continueWithPhases(ctx, span, state, repository.FINALLY)
+	case repository.FINALLY:
+		h.continueWithPhases(ctx, span, state)
+	default:
+		state.Outcome = repository.SUCCESS
+		h.continueWithPhases(ctx, span, state, repository.FINALLY)
+	}
+}
+
+// CancelExecution cancels the active steps of the execution and runs its finally steps, it ends cancelled
+func (h *Handler) CancelExecution(ctx context.Context, executionID uint) {
+	ctx, span := h.tracer.Start(ctx, "CancelExecution")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+
+	state := h.executionRepository.GetStateByExecutionID(ctx, executionID)
+	if state.IsFinished() {
+		return
+	}
+	h.cancelActiveSteps(ctx, state)
+	state.Outcome = repository.CANCELLED
+	if state.Phase == repository.FINALLY {
+		h.continueWithPhases(ctx, span, state)
+		return
+	}
+	h.continueWithPhases(ctx, span, state, repository.FINALLY)
+}
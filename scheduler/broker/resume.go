@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrExecutionNotFailed = errors.New("execution is not failed")
+	ErrExecutionNotActive = errors.New("execution is not running")
+	ErrExecutionNotPaused = errors.New("execution is not paused")
+)
+
+// RetryExecution resumes a failed execution from the steps that did not succeed, keeping the outputs of the rest.
+// The error output is cleared and the given arguments override the ones of the submission
+func (h *Handler) RetryExecution(ctx context.Context, executionID uint, arguments map[string]string) error {
+	ctx, span := h.tracer.Start(ctx, "RetryExecution")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	if state == nil || state.Status != repository.FAILED {
+		return ErrExecutionNotFailed
+	}
+
+	outputs := make([]*repository.KeyValueOutput, 0, len(state.Outputs))
+	for _, output := range state.Outputs {
+		if output.Key == "error" {
+			h.executionRepository.DeleteOutput(ctx, output)
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+	state.Outputs = outputs
+
+	for key, value := range arguments {
+		var argument *repository.KeyValueArgument
+		for _, a := range state.Arguments {
+			if a.Key == key {
+				argument = a
+				break
+			}
+		}
+		if argument == nil {
+			argument = &repository.KeyValueArgument{Key: key, StateID: state.ID}
+			state.Arguments = append(state.Arguments, argument)
+		}
+		argument.Value = value
+		h.executionRepository.UpdateArgument(ctx, argument)
+	}
+
+	// Only the successes that the rerun would reach again are kept. The rest of the states are removed, the ones of the
+	// phase steps included, so that they run again. Steps of the workflow that failed, or were still active when the
+	// execution failed, are dispatched again once the steps before them are kept
+	kept := keptSteps(execution)
+	toRetry := make([]*repository.Step, 0)
+	stepStates := make([]*repository.StepState, 0, len(state.StepStates))
+	for _, stepState := range state.StepStates {
+		if kept[stepState.Name] {
+			stepStates = append(stepStates, stepState)
+			continue
+		}
+		h.executionRepository.DeleteStepState(ctx, stepState)
+		step := execution.GetStep(stepState.Name)
+		if step != nil && step.Phase == "" && upstreamKept(execution, kept, stepState.Name) {
+			log.Printf("Retrying step %s of execution %d\n", step.Name, executionID)
+			toRetry = append(toRetry, step)
+		}
+	}
+	state.StepStates = stepStates
+	// The execution has to be active before the steps are handled
+	state.Status = repository.PENDING
+	state.Phase = ""
+	state.Outcome = ""
+	h.executionRepository.UpdateState(ctx, state)
+	h.advanceExecution(ctx, span, state, toRetry)
+	return nil
+}
+
+// keptSteps returns the steps of the workflow that keep their success when the execution is retried: the ones whose
+// dependencies and branching steps are kept too. Otherwise the rerun could take another branch, or find a join
+// step satisfied before the steps it depends on ran again
+func keptSteps(execution *repository.Execution) map[string]bool {
+	kept := make(map[string]bool)
+	// The graph has no cycles, the steps are kept from the roots until no other one can be
+	for changed := true; changed; {
+		changed = false
+		for _, stepState := range execution.State.StepStates {
+			// Skipped steps are kept along with the branch that skipped them
+			if kept[stepState.Name] || (stepState.Status != repository.SUCCESS && stepState.Status != repository.SKIPPED) {
+				continue
+			}
+			step := execution.GetStep(stepState.Name)
+			if step == nil || step.Phase != "" || !upstreamKept(execution, kept, stepState.Name) {
+				continue
+			}
+			kept[stepState.Name] = true
+			changed = true
+		}
+	}
+	return kept
+}
+
+// upstreamKept reports whether the dependencies of the step are kept, along with one of the branching steps that
+// can choose it if it is the path of any. The items of a foreach step follow the foreach step
+func upstreamKept(execution *repository.Execution, kept map[string]bool, name string) bool {
+	if foreach, _, ok := repository.ParseItemStepName(name); ok {
+		name = foreach
+	}
+	step := execution.GetStep(name)
+	if step == nil {
+		return false
+	}
+	for _, dependency := range step.Dependencies {
+		if !kept[dependency.DependsOn] {
+			return false
+		}
+	}
+	sources := branchSources(execution, name)
+	for _, source := range sources {
+		if kept[source] {
+			return true
+		}
+	}
+	return len(sources) == 0
+}
+
+// branchSources returns the if and switch steps that have the step as one of their paths
+func branchSources(execution *repository.Execution, name string) []string {
+	sources := make([]string, 0)
+	for _, s := range execution.Steps {
+		if slices.Contains(branchPaths(s), name) {
+			sources = append(sources, s.Name)
+		}
+	}
+	return sources
+}
+
+// PauseExecution stops dispatching the steps of the execution, the steps that are executing are allowed to finish
+// and the steps that become ready are held until the execution is resumed
+func (h *Handler) PauseExecution(ctx context.Context, executionID uint) error {
+	state := h.executionRepository.GetStateByExecutionID(ctx, executionID)
+	if state.Status != repository.PENDING && state.Status != repository.EXECUTING && state.Status != repository.WAITING {
+		return ErrExecutionNotActive
+	}
+	state.Status = repository.PAUSED
+	h.executionRepository.UpdateState(ctx, state)
+	return nil
+}
+
+// ResumeExecution enqueues the steps that were held while the execution was paused
+func (h *Handler) ResumeExecution(ctx context.Context, executionID uint) error {
+	ctx, span := h.tracer.Start(ctx, "ResumeExecution")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	if state == nil || state.Status != repository.PAUSED {
+		return ErrExecutionNotPaused
+	}
+	// The execution has to be active before the held steps are handled
+	state.Status = repository.PENDING
+	refreshStatus(state)
+	h.executionRepository.UpdateState(ctx, state)
+
+	for _, stepState := range state.StepStates {
+		if stepState.Status != repository.PENDING {
+			continue
+		}
+		step := execution.GetStep(stepState.Name)
+		if step == nil {
+			continue
+		}
+		stepState.DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		h.executionRepository.UpdateStepState(ctx, stepState)
+		err := h.EnqueueExecutionStep(step.ToExecutionStepDTO(), state.Priority, ctx, span)
+		if err != nil {
+			h.failStep(ctx, span, state, stepState, fmt.Sprintf("Failed to enqueue step %s: %s", step.Name, err))
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retryStep schedules the failed step to be dispatched again if the error is retryable and its retry policy allows it.
+// Returns false when the step has to fail
+func (h *Handler) retryStep(
+	ctx context.Context,
+	span trace.Span,
+	execution *repository.Execution,
+	stepState *repository.StepState,
+	outputErr interface{},
+) bool {
+	step := execution.GetStep(stepState.Name)
+	stepErr := stepError(outputErr)
+	if step == nil || step.Retry == nil || !stepErr.Retryable || !step.Retry.ShouldRetry(stepState.Attempt, stepErr.Code) {
+		return false
+	}
+	delay := step.Retry.Delay(stepState.Attempt)
+	stepState.Status = repository.RETRYING
+	recordStepError(stepState, stepErr)
+	stepState.RetryAt = sql.NullTime{Time: time.Now().Add(delay), Valid: true}
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+
+	state := execution.State
+	refreshStatus(state)
+	h.executionRepository.UpdateState(context.Background(), state)
+	span.SetAttributes(attribute.Int("Attempt", int(stepState.Attempt)))
+	h.scheduleRetry(ctx, state.ExecutionID, stepState.Name, delay)
+	return true
+}
+
+func (h *Handler) scheduleRetry(ctx context.Context, executionID uint, stepName string, delay time.Duration) {
+	h.jobsRepository.CreateDelayedJob(uint(delay.Seconds()), ctx, func() {
+		h.InTransaction(context.Background(), func(tx *Handler) error {
+			tx.DispatchRetry(executionID, stepName)
+			return nil
+		})
+	}, uuid.New().String())
+}
+
+// DispatchRetry enqueues again a step that is waiting for a retry, increasing its attempt
+func (h *Handler) DispatchRetry(executionID uint, stepName string) {
+	ctx, span := h.tracer.Start(context.Background(), "DispatchRetry")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+	span.SetAttributes(attribute.String("Step", stepName))
+
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	stepState := state.GetStepState(stepName)
+	if (!state.IsActive() && state.Status != repository.PAUSED) || stepState == nil || stepState.Status != repository.RETRYING {
+		log.Printf("Step %s is not waiting for a retry\n", stepName)
+		return
+	}
+	// Jobs of previous retries of the step, like the ones of a transaction that was retried, are ignored
+	if !stepState.RetryAt.Valid || time.Until(stepState.RetryAt.Time) > time.Second {
+		log.Printf("Retry of step %s is not due yet\n", stepName)
+		return
+	}
+	step := execution.GetStep(stepName)
+	if step == nil {
+		span.RecordError(fmt.Errorf("step not found: %s", stepName))
+		return
+	}
+	stepState.Attempt++
+	stepState.Status = repository.PENDING
+	stepState.RetryAt = sql.NullTime{}
+	stepState.DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	h.executionRepository.UpdateStepState(ctx, stepState)
+	span.SetAttributes(attribute.Int("Attempt", int(stepState.Attempt)))
+	if state.Status == repository.PAUSED {
+		// Held as pending until the execution is resumed
+		return
+	}
+
+	err := h.EnqueueExecutionStep(step.ToExecutionStepDTO(), state.Priority, ctx, span)
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, fmt.Sprintf("Failed to enqueue step %s: %s", stepName, err))
+	}
+}
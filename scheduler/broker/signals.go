@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"time"
+
+	"github.com/goccy/go-json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrSignalNotAwaited = errors.New("no step is waiting for the signal")
+
+// outputValue converts a value to text, strings are kept as they are and the rest are encoded as JSON
+func outputValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes)
+}
+
+// SignalHandler makes the step wait until the signal is sent to the execution, the signal is named after the step
+// unless the signal input says otherwise. If expiresInSeconds is set and the signal doesn't arrive in time
+// the execution continues with the onTimeout step, or fails if there is none
+func (h *Handler) SignalHandler(
+	step repository.ExecutionStepDTO,
+	state *repository.State,
+	inputs map[string]interface{},
+	span trace.Span,
+	ctx context.Context,
+) {
+	stepState := state.GetStepState(step.Name)
+	signal, _ := inputs["signal"].(string)
+	if signal == "" {
+		signal = step.Name
+	}
+	stepState.Status = repository.WAITING
+	stepState.Signal = signal
+	stepState.WakeAt = sql.NullTime{}
+	if expiresIn, ok := inputs["expiresInSeconds"]; ok {
+		delay, err := secondsDuration("expiresInSeconds", expiresIn)
+		if err != nil {
+			h.failStep(ctx, span, state, stepState, err.Error())
+			return
+		}
+		stepState.WakeAt = sql.NullTime{Time: time.Now().Add(delay), Valid: true}
+		h.scheduleWake(ctx, state.ExecutionID, step.Name, delay)
+	}
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	span.SetAttributes(attribute.String("Signal", signal))
+	// The execution waits unless other steps are running, a compensation keeps compensating
+	if state.Status != repository.COMPENSATING {
+		refreshStatus(state)
+		h.executionRepository.UpdateState(context.Background(), state)
+	}
+}
+
+// Signal delivers the signal to the steps of the execution waiting for it, the payload is stored as their outputs
+// and the steps that depend on them are dispatched
+func (h *Handler) Signal(ctx context.Context, executionID uint, name string, payload map[string]interface{}) error {
+	ctx, span := h.tracer.Start(ctx, "Signal")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+	span.SetAttributes(attribute.String("Signal", name))
+
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	if state == nil || (!state.IsActive() && state.Status != repository.PAUSED) {
+		return ErrSignalNotAwaited
+	}
+	waiting := make([]*repository.StepState, 0)
+	for _, stepState := range state.StepStates {
+		if stepState.Status == repository.WAITING && stepState.Signal == name {
+			waiting = append(waiting, stepState)
+		}
+	}
+	if len(waiting) == 0 {
+		return ErrSignalNotAwaited
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"outputs": payload})
+	if err != nil {
+		span.RecordError(err)
+	}
+	for _, stepState := range waiting {
+		for key, value := range payload {
+			h.setOutput(ctx, state, fmt.Sprintf("%s.%s", stepState.Name, key), value)
+		}
+		stepState.Status = repository.SUCCESS
+		stepState.WakeAt = sql.NullTime{}
+		h.executionRepository.UpdateStepState(ctx, stepState)
+		h.finishLatestStepRun(ctx, executionID, stepState.Name, repository.SUCCESS, response)
+		log.Printf("Step %s of execution %d received signal %s\n", stepState.Name, executionID, name)
+	}
+	next := make([]*repository.Step, 0)
+	dispatched := make(map[string]bool)
+	for _, stepState := range waiting {
+		for _, step := range execution.ReadySteps(stepState.Name) {
+			if !dispatched[step.Name] {
+				dispatched[step.Name] = true
+				next = append(next, step)
+			}
+		}
+	}
+	h.advanceExecution(ctx, span, state, next)
+	return nil
+}
+
+// expireSignal handles a step whose signal didn't arrive in time, the execution continues with the onTimeout step
+// or with the steps that depend on it if onTimeout is continue. Without onTimeout the step fails
+func (h *Handler) expireSignal(
+	ctx context.Context,
+	span trace.Span,
+	execution *repository.Execution,
+	stepState *repository.StepState,
+) {
+	state := execution.State
+	log.Printf("Signal %s of step %s of execution %d expired\n", stepState.Signal, stepState.Name, execution.ID)
+	span.AddEvent("SignalExpired", trace.WithAttributes(attribute.String("Step", stepState.Name)))
+	var onTimeout string
+	if step := execution.GetStep(stepState.Name); step != nil {
+		onTimeout = step.GetInput("onTimeout")
+	}
+	if onTimeout == "" {
+		expiredErr := map[string]interface{}{
+			"code": "timeout",
+			"msg":  fmt.Sprintf("Signal %s of step %s expired", stepState.Signal, stepState.Name),
+		}
+		response, err := json.Marshal(map[string]interface{}{"outputs": map[string]interface{}{"error": expiredErr}})
+		if err != nil {
+			span.RecordError(err)
+		}
+		h.finishLatestStepRun(ctx, execution.ID, stepState.Name, repository.FAILED, response)
+		h.failStep(ctx, span, state, stepState, expiredErr)
+		return
+	}
+
+	var next []*repository.Step
+	if onTimeout != "continue" {
+		nextStep := execution.GetStep(onTimeout)
+		if nextStep == nil {
+			h.finishLatestStepRun(ctx, execution.ID, stepState.Name, repository.FAILED, errorResponse(fmt.Sprintf("Path %s is not found", onTimeout)))
+			h.failStep(ctx, span, state, stepState, fmt.Sprintf("Path %s is not found", onTimeout))
+			return
+		}
+		next = []*repository.Step{nextStep}
+	}
+	h.setOutput(ctx, state, stepState.Name+".timedOut", true)
+	stepState.Status = repository.SUCCESS
+	stepState.WakeAt = sql.NullTime{}
+	h.executionRepository.UpdateStepState(ctx, stepState)
+	h.finishLatestStepRun(ctx, execution.ID, stepState.Name, repository.SUCCESS, nil)
+	if onTimeout == "continue" {
+		next = execution.ReadySteps(stepState.Name)
+	}
+	h.advanceExecution(ctx, span, state, next)
+}
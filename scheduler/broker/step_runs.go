@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"scheduler/repository"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// startStepRun records the dispatch of a step with the inputs resolved for it
+func (h *Handler) startStepRun(
+	ctx context.Context,
+	state *repository.State,
+	stepState *repository.StepState,
+	inputs map[string]interface{},
+) *repository.StepRun {
+	bytes, err := json.Marshal(inputs)
+	if err != nil {
+		log.Printf("Failed to marshal inputs: %s\n", err)
+	}
+	run := &repository.StepRun{
+		ExecutionID:  state.ExecutionID,
+		StepName:     stepState.Name,
+		Attempt:      stepState.Attempt,
+		Inputs:       string(bytes),
+		Status:       repository.EXECUTING,
+		DispatchedAt: stepState.DispatchedAt,
+		StartedAt:    sql.NullTime{Time: time.Now(), Valid: true},
+	}
+	h.executionRepository.SaveStepRun(ctx, run)
+	return run
+}
+
+// finishStepRun records the outcome of a step run and the raw response that produced it
+func (h *Handler) finishStepRun(ctx context.Context, run *repository.StepRun, status string, response []byte) {
+	if run == nil {
+		return
+	}
+	run.Status = status
+	run.Response = string(response)
+	run.FinishedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	h.executionRepository.SaveStepRun(ctx, run)
+}
+
+func (h *Handler) finishLatestStepRun(ctx context.Context, executionID uint, stepName string, status string, response []byte) {
+	run := h.executionRepository.GetLatestStepRun(ctx, executionID, stepName)
+	if run == nil {
+		log.Printf("No run found for step %s of execution %d\n", stepName, executionID)
+		return
+	}
+	h.finishStepRun(ctx, run, status, response)
+}
+
+// errorResponse builds a response like the ones services send when they fail, for runs that fail in the scheduler
+func errorResponse(msg string) []byte {
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"outputs": map[string]interface{}{
+			"error": map[string]string{
+				"msg": msg,
+			},
+		},
+	})
+	return bytes
+}
@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"slices"
+	"strconv"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// subworkflowArguments parses the arguments of a child execution, given as an object or as JSON
+func subworkflowArguments(value interface{}) (map[string]string, error) {
+	var object map[string]interface{}
+	switch v := value.(type) {
+	case nil:
+		return map[string]string{}, nil
+	case map[string]interface{}:
+		object = v
+	case string:
+		err := json.Unmarshal([]byte(v), &object)
+		if err != nil {
+			return nil, fmt.Errorf("args is not a JSON object: %s", v)
+		}
+	default:
+		return nil, fmt.Errorf("args is not a JSON object: %v", v)
+	}
+	arguments := make(map[string]string)
+	for k, v := range object {
+		arguments[k] = outputValue(v)
+	}
+	return arguments, nil
+}
+
+// subworkflowExecution builds the child execution of a subworkflow step. The workflow is either an inline submission
+// or the ID of a workflow, whose steps are taken from the last execution submitted for it.
+// A workflow can't start itself, neither directly nor through the subworkflows it started.
+// The given arguments override the ones of the inline submission
+func (h *Handler) subworkflowExecution(ctx context.Context, state *repository.State, inputs map[string]interface{}) (*repository.Execution, error) {
+	arguments, err := subworkflowArguments(inputs["args"])
+	if err != nil {
+		return nil, err
+	}
+	if workflow, ok := inputs["workflow"]; ok {
+		var bytes []byte
+		if str, isString := workflow.(string); isString {
+			bytes = []byte(str)
+		} else {
+			bytes, err = json.Marshal(workflow)
+			if err != nil {
+				return nil, err
+			}
+		}
+		submission := repository.ExecutionSubmissionDTO{}
+		err = json.Unmarshal(bytes, &submission)
+		if err != nil {
+			return nil, fmt.Errorf("workflow is not a valid submission: %s", err)
+		}
+		if submission.Arguments == nil {
+			submission.Arguments = make(map[string]string)
+		}
+		for k, v := range arguments {
+			submission.Arguments[k] = v
+		}
+		// The child runs right away
+		submission.Parameters = repository.ExecutionsParamsDTO{}
+		execution := submission.ToExecution(repository.PENDING)
+		if execution == nil {
+			return nil, fmt.Errorf("workflow is not a valid submission")
+		}
+		return execution, nil
+	}
+
+	var workflowID uint64
+	switch v := inputs["workflowID"].(type) {
+	case float64:
+		workflowID = uint64(v)
+	case string:
+		workflowID, err = strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("workflowID is not a number: %s", v)
+		}
+	default:
+		return nil, fmt.Errorf("neither workflow nor workflowID are specified")
+	}
+	if slices.Contains(h.executionRepository.GetWorkflowLineage(ctx, state.ExecutionID), uint(workflowID)) {
+		return nil, fmt.Errorf("workflow %d would start itself as a subworkflow", workflowID)
+	}
+	latest := h.executionRepository.GetLatestWorkflowExecution(ctx, uint(workflowID))
+	if latest == nil {
+		return nil, fmt.Errorf("workflow %d has no executions to take its steps from", workflowID)
+	}
+	steps := repository.CloneSteps(latest.Steps)
+	return &repository.Execution{
+		WorkflowID: uint(workflowID),
+		Steps:      steps,
+		State:      repository.NewState(repository.PENDING, steps, arguments),
+	}, nil
+}
+
+// SubworkflowHandler submits a child execution and makes the step wait until the child ends,
+// the outputs of the child are then copied to the step
+func (h *Handler) SubworkflowHandler(
+	step repository.ExecutionStepDTO,
+	state *repository.State,
+	inputs map[string]interface{},
+	span trace.Span,
+	ctx context.Context,
+) {
+	stepState := state.GetStepState(step.Name)
+	child, err := h.subworkflowExecution(ctx, state, inputs)
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	child.ExecutionUUID = uuid.New().String()
+	child.ParentExecutionID = state.ExecutionID
+	child.ParentStepName = step.Name
+	child.State.Priority = state.Priority
+	child.State.ConcurrencyKey = state.ConcurrencyKey
+	child.State.ConcurrencyLimit = state.ConcurrencyLimit
+
+	stepState.Status = repository.WAITING
+	stepState.WakeAt = sql.NullTime{}
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	// The execution waits unless other steps are running, a compensation keeps compensating
+	if state.Status != repository.COMPENSATING {
+		refreshStatus(state)
+		h.executionRepository.UpdateState(context.Background(), state)
+	}
+
+	h.executionRepository.CreateExecution(ctx, child)
+	log.Printf("Step %s of execution %d started subworkflow %s\n", step.Name, state.ExecutionID, child.ExecutionUUID)
+	span.SetAttributes(attribute.String("Subworkflow", child.ExecutionUUID))
+	h.enqueueRootSteps(child, ctx, span)
+}
+
+// finishSubworkflow copies the outputs of a child execution that ended to the step that started it,
+// the step succeeds if the child succeeded and fails otherwise
+func (h *Handler) finishSubworkflow(ctx context.Context, span trace.Span, child *repository.Execution) {
+	parent := h.executionRepository.GetExecutionById(ctx, child.ParentExecutionID)
+	state := parent.State
+	stepState := state.GetStepState(child.ParentStepName)
+	if (!state.IsActive() && state.Status != repository.PAUSED) || stepState == nil || stepState.Status != repository.WAITING {
+		log.Printf("Step %s is not waiting for subworkflow %s\n", child.ParentStepName, child.ExecutionUUID)
+		return
+	}
+
+	outputs := make(map[string]interface{})
+	for _, output := range child.State.Outputs {
+		if output.Key == "error" {
+			continue
+		}
+		outputs[output.Key] = output.Value.Decode()
+		h.setOutput(ctx, state, fmt.Sprintf("%s.%s", stepState.Name, output.Key), outputs[output.Key])
+	}
+	response, err := json.Marshal(map[string]interface{}{"outputs": outputs})
+	if err != nil {
+		span.RecordError(err)
+	}
+	if child.State.Status != repository.SUCCESS {
+		subworkflowErr := map[string]interface{}{
+			"code": "subworkflow",
+			"msg":  fmt.Sprintf("Subworkflow %s ended %s", child.ExecutionUUID, child.State.Status),
+		}
+		for _, output := range child.State.Outputs {
+			if output.Key == "error" {
+				subworkflowErr["details"] = output.Value.Decode()
+			}
+		}
+		h.finishLatestStepRun(ctx, parent.ID, stepState.Name, repository.FAILED, response)
+		h.failStep(ctx, span, state, stepState, subworkflowErr)
+		return
+	}
+	stepState.Status = repository.SUCCESS
+	h.executionRepository.UpdateStepState(ctx, stepState)
+	h.finishLatestStepRun(ctx, parent.ID, stepState.Name, repository.SUCCESS, response)
+	h.advanceExecution(ctx, span, state, parent.ReadySteps(stepState.Name))
+}
+
+// cancelChildExecutions cancels the subworkflows of the execution that are still running
+func (h *Handler) cancelChildExecutions(ctx context.Context, executionID uint) {
+	for _, child := range h.executionRepository.GetChildExecutions(ctx, executionID) {
+		if child.State != nil && !child.State.IsFinished() {
+			log.Printf("Cancelling subworkflow %s of execution %d\n", child.ExecutionUUID, executionID)
+			h.CancelExecution(ctx, child.ID)
+		}
+	}
+}
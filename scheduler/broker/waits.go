@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"scheduler/repository"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// waitDuration parses how long a sleep or waitUntil step waits,
+// sleep takes the seconds to wait and waitUntil an RFC 3339 timestamp
+func waitDuration(task string, inputs map[string]interface{}, now time.Time) (time.Duration, error) {
+	if task == "waitUntil" {
+		until, ok := inputs["until"].(string)
+		if !ok {
+			return 0, fmt.Errorf("until is not specified")
+		}
+		timestamp, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return 0, fmt.Errorf("until is not an RFC 3339 timestamp: %s", until)
+		}
+		return max(timestamp.Sub(now), 0), nil
+	}
+	return secondsDuration("seconds", inputs["seconds"])
+}
+
+// secondsDuration parses an input with a number of seconds, given as a number or as a string
+func secondsDuration(name string, value interface{}) (time.Duration, error) {
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s is not a number: %s", name, v)
+		}
+		seconds = parsed
+	default:
+		return 0, fmt.Errorf("%s is not specified", name)
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("%s can't be negative: %v", name, seconds)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// WaitHandler makes the step wait for a duration or until a timestamp without blocking a worker,
+// a delayed job wakes it up and dispatches the steps that depend on it
+func (h *Handler) WaitHandler(
+	step repository.ExecutionStepDTO,
+	state *repository.State,
+	inputs map[string]interface{},
+	span trace.Span,
+	ctx context.Context,
+) {
+	execution := h.executionRepository.GetExecutionById(ctx, state.ExecutionID)
+	execution.State = state
+	stepState := state.GetStepState(step.Name)
+	delay, err := waitDuration(step.Task, inputs, time.Now())
+	if err != nil {
+		h.failStep(ctx, span, state, stepState, err.Error())
+		return
+	}
+	if delay <= 0 {
+		stepState.Status = repository.SUCCESS
+		h.executionRepository.UpdateStepState(context.Background(), stepState)
+		h.advanceExecution(ctx, span, state, execution.ReadySteps(step.Name))
+		return
+	}
+
+	stepState.Status = repository.WAITING
+	stepState.WakeAt = sql.NullTime{Time: time.Now().Add(delay), Valid: true}
+	h.executionRepository.UpdateStepState(context.Background(), stepState)
+	span.SetAttributes(attribute.String("WakeAt", stepState.WakeAt.Time.Format(time.RFC3339)))
+	h.scheduleWake(ctx, state.ExecutionID, step.Name, delay)
+	// The execution waits unless other steps are running, a compensation keeps compensating
+	if state.Status != repository.COMPENSATING {
+		refreshStatus(state)
+		h.executionRepository.UpdateState(context.Background(), state)
+	}
+}
+
+func (h *Handler) scheduleWake(ctx context.Context, executionID uint, stepName string, delay time.Duration) {
+	seconds := uint(math.Max(1, math.Ceil(delay.Seconds())))
+	h.jobsRepository.CreateDelayedJob(seconds, ctx, func() {
+		h.InTransaction(context.Background(), func(tx *Handler) error {
+			tx.WakeStep(executionID, stepName)
+			return nil
+		})
+	}, uuid.New().String())
+}
+
+// WakeStep finishes a waiting step and dispatches the steps that depend on it
+func (h *Handler) WakeStep(executionID uint, stepName string) {
+	ctx, span := h.tracer.Start(context.Background(), "WakeStep")
+	defer span.End()
+	span.SetAttributes(attribute.Int("ExecutionId", int(executionID)))
+	span.SetAttributes(attribute.String("Step", stepName))
+
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	stepState := state.GetStepState(stepName)
+	if (!state.IsActive() && state.Status != repository.PAUSED) || stepState == nil || stepState.Status != repository.WAITING {
+		log.Printf("Step %s is not waiting\n", stepName)
+		return
+	}
+	// Jobs of previous waits of the step, like before the execution was retried, are ignored
+	if !stepState.WakeAt.Valid || time.Until(stepState.WakeAt.Time) > time.Second {
+		log.Printf("Step %s is not due yet\n", stepName)
+		return
+	}
+	if stepState.Signal != "" {
+		h.expireSignal(ctx, span, execution, stepState)
+		return
+	}
+	stepState.Status = repository.SUCCESS
+	stepState.WakeAt = sql.NullTime{}
+	h.executionRepository.UpdateStepState(ctx, stepState)
+	h.finishLatestStepRun(ctx, executionID, stepName, repository.SUCCESS, nil)
+	h.advanceExecution(ctx, span, state, execution.ReadySteps(stepName))
+}
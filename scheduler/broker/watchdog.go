@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"scheduler/repository"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CheckTimeouts fails the executing steps that exceeded their timeout, or retries them if their retry policy allows it,
+// and times out the executions that exceeded their deadline. It runs periodically on the leader,
+// responses that arrive after the timeout are ignored since the step is no longer executing.
+// It also dispatches the retries and wakes up the waits that are due, their delayed jobs only run on the leader
+// so the ones scheduled by other instances are never run. Each execution is checked in its own transaction,
+// so that a conflict with a response of one execution doesn't hold back the rest
+func (h *Handler) CheckTimeouts() {
+	ctx, span := h.tracer.Start(context.Background(), "CheckTimeouts")
+	defer span.End()
+
+	now := time.Now()
+	for _, executionID := range h.watchdogExecutions(ctx, now) {
+		err := h.InTransaction(ctx, func(tx *Handler) error {
+			tx.checkExecution(ctx, span, executionID, now)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to check execution %d: %s\n", executionID, err)
+			span.RecordError(err)
+		}
+	}
+}
+
+// watchdogExecutions returns the executions that are past their deadline or have steps that timed out,
+// or whose retries or wakes are due, each of them once
+func (h *Handler) watchdogExecutions(ctx context.Context, now time.Time) []uint {
+	states := h.executionRepository.GetStatesPastDeadline(ctx, now)
+	states = append(states, h.executionRepository.GetStatesWithTimedOutSteps(ctx, now)...)
+	states = append(states, h.executionRepository.GetStatesWithDueRetries(ctx, now)...)
+	states = append(states, h.executionRepository.GetStatesWithDueWakes(ctx, now)...)
+	executionIDs := make([]uint, 0, len(states))
+	for _, state := range states {
+		if !slices.Contains(executionIDs, state.ExecutionID) {
+			executionIDs = append(executionIDs, state.ExecutionID)
+		}
+	}
+	return executionIDs
+}
+
+// checkExecution times out the execution if it is past its deadline, otherwise it times out its steps
+// and dispatches its retries and wakes that are due
+func (h *Handler) checkExecution(ctx context.Context, span trace.Span, executionID uint, now time.Time) {
+	execution := h.executionRepository.GetExecutionById(ctx, executionID)
+	state := execution.State
+	if state.IsFinished() {
+		return
+	}
+	if state.DeadlineAt.Valid && state.DeadlineAt.Time.Before(now) {
+		h.timeoutExecution(ctx, span, executionID)
+		return
+	}
+	for _, stepState := range state.StepStates {
+		if state.IsFinished() {
+			return
+		}
+		if stepState.Status != repository.EXECUTING || !stepState.TimeoutAt.Valid || stepState.TimeoutAt.Time.After(now) {
+			continue
+		}
+		// The response may have arrived in the meantime
+		if !h.executionRepository.ClaimStepDispatch(ctx, stepState.ID, stepState.DispatchID) {
+			continue
+		}
+		stepState.DispatchID = ""
+		h.releaseConcurrency(ctx, span, stepState)
+		h.timeoutStep(ctx, span, execution, stepState)
+	}
+	for _, stepState := range state.StepStates {
+		if stepState.Status == repository.RETRYING && stepState.RetryAt.Valid && !stepState.RetryAt.Time.After(now) {
+			h.DispatchRetry(executionID, stepState.Name)
+		}
+		if stepState.Status == repository.WAITING && stepState.WakeAt.Valid && !stepState.WakeAt.Time.After(now) {
+			h.WakeStep(executionID, stepState.Name)
+		}
+	}
+}
+
+func (h *Handler) timeoutStep(
+	ctx context.Context,
+	span trace.Span,
+	execution *repository.Execution,
+	stepState *repository.StepState,
+) {
+	var timeoutSeconds uint
+	if step := execution.GetStep(stepState.Name); step != nil {
+		timeoutSeconds = step.TimeoutSeconds
+	}
+	timeoutErr := map[string]interface{}{
+		"code": "timeout",
+		"msg":  fmt.Sprintf("Step %s timed out after %d seconds", stepState.Name, timeoutSeconds),
+	}
+	log.Printf("Step %s of execution %d timed out\n", stepState.Name, execution.ID)
+	response, err := json.Marshal(map[string]interface{}{"outputs": map[string]interface{}{"error": timeoutErr}})
+	if err != nil {
+		span.RecordError(err)
+	}
+	h.finishLatestStepRun(ctx, execution.ID, stepState.Name, repository.FAILED, response)
+	span.AddEvent("StepTimeout", trace.WithAttributes(
+		attribute.Int("ExecutionId", int(execution.ID)),
+		attribute.String("Step", stepState.Name),
+	))
+	if h.retryStep(ctx, span, execution, stepState, timeoutErr) {
+		return
+	}
+
+	h.failStep(ctx, span, execution.State, stepState, timeoutErr)
+}
+
+// timeoutExecution ends an execution that exceeded its deadline. Its active steps are cancelled and the execution
+// runs its onFailure and finally steps as cleanup, without compensations, then it ends timed out
+func (h *Handler) timeoutExecution(ctx context.Context, span trace.Span, executionID uint) {
+	state := h.executionRepository.GetStateByExecutionID(ctx, executionID)
+	if state.IsFinished() || !state.DeadlineAt.Valid {
+		return
+	}
+	log.Printf("Execution %d exceeded its deadline\n", executionID)
+	span.AddEvent("ExecutionTimeout", trace.WithAttributes(attribute.Int("ExecutionId", int(executionID))))
+	timeoutErr := stepError(map[string]interface{}{
+		"code":      "deadline_exceeded",
+		"msg":       fmt.Sprintf("Execution exceeded its deadline of %s", state.DeadlineAt.Time.Format(time.RFC3339)),
+		"retryable": false,
+		"worker":    "scheduler",
+	})
+	// The deadline only applies once, the cleanup steps run without it
+	state.DeadlineAt = sql.NullTime{}
+	h.cancelActiveSteps(ctx, state)
+	h.setErrorOutput(ctx, state, timeoutErr)
+	state.Outcome = repository.TIMED_OUT
+	// A paused execution would hold its cleanup steps
+	if state.Status == repository.PAUSED {
+		state.Status = repository.PENDING
+	}
+	switch state.Phase {
+	case repository.FINALLY:
+		h.continueWithPhases(ctx, span, state)
+	case repository.ON_FAILURE:
+		h.continueWithPhases(ctx, span, state, repository.FINALLY)
+	default:
+		h.continueWithPhases(ctx, span, state, repository.ON_FAILURE, repository.FINALLY)
+	}
+}
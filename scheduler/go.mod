@@ -25,6 +25,7 @@ require (
 	gorm.io/driver/postgres v1.5.10
 	gorm.io/gorm v1.25.12
 	gotest.tools/v3 v3.5.1
+	priorityfetcher v0.0.0
 )
 
 require (
@@ -128,3 +129,5 @@ require (
 	google.golang.org/protobuf v1.35.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace priorityfetcher => ../priorityfetcher
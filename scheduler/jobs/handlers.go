@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	elector "github.com/go-co-op/gocron-etcd-elector"
 	"github.com/go-co-op/gocron/v2"
 	"github.com/google/uuid"
@@ -57,6 +58,27 @@ func (cr *JobsRepository) CreateDelayedJob(delay uint, ctx context.Context, job
 	}
 }
 
+// CreateIntervalJob creates a job that runs every interval, like the rest of the jobs it only runs on the leader
+func (cr *JobsRepository) CreateIntervalJob(interval time.Duration, ctx context.Context, job func(), jobUUID string) {
+	scheduler := *cr.scheduler
+	identifier, parseErr := uuid.Parse(jobUUID)
+	if parseErr != nil {
+		log.Printf("Failed to parse UUID: %v\n", parseErr)
+	}
+	_, err := scheduler.NewJob(
+		gocron.DurationJob(interval),
+		gocron.NewTask(func() {
+			if cr.elector.IsLeader(ctx) == nil {
+				job()
+			} else {
+				log.Printf("Not leader, skipping job\n")
+			}
+		}), gocron.WithIdentifier(identifier), gocron.WithSingletonMode(gocron.LimitModeReschedule))
+	if err != nil {
+		log.Printf("Failed to create interval job: %v\n", err)
+	}
+}
+
 func (cr *JobsRepository) CancelJob(jobUUID string) error {
 	scheduler := *cr.scheduler
 	identifier, parseErr := uuid.Parse(jobUUID)
@@ -65,3 +87,10 @@ func (cr *JobsRepository) CancelJob(jobUUID string) error {
 	}
 	return scheduler.RemoveJob(identifier)
 }
+
+// Shutdown stops the scheduler, waiting for the jobs that are running, and gives up the leadership
+func (cr *JobsRepository) Shutdown() error {
+	scheduler := *cr.scheduler
+	err := scheduler.Shutdown()
+	return errors.Join(err, cr.elector.Stop())
+}
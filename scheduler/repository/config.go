@@ -6,6 +6,7 @@ import (
 	"gorm.io/gorm"
 	"log"
 	"os"
+	"strings"
 )
 
 func Initialize() *gorm.DB {
@@ -23,13 +24,71 @@ func Initialize() *gorm.DB {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	// Run migrations
-	err = connection.AutoMigrate(&Execution{}, &State{}, &Step{}, &KeyValueOutput{}, &KeyValueArgument{}, &KeyValueStep{}, &ExecutionParams{}, &Tags{})
+	err = migrateOutputValues(connection)
+	if err != nil {
+		log.Fatalf("Failed to migrate output values: %v", err)
+	}
+	err = connection.AutoMigrate(&Execution{}, &State{}, &Step{}, &StepState{}, &StepRun{}, &StepDependency{}, &RetryPolicy{}, &KeyValueOutput{}, &KeyValueArgument{}, &KeyValueStep{}, &ExecutionParams{}, &Tags{}, &OutboxMessage{}, &ConcurrencyLease{}, &QueuedStep{})
 	if err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
+	err = migrateStepColumn(connection)
+	if err != nil {
+		log.Fatalf("Failed to migrate current steps: %v", err)
+	}
 	err = connection.Use(otelgorm.NewPlugin())
 	if err != nil {
 		log.Printf("Failed to install instrumentation: %v", err)
 	}
 	return connection
 }
+
+// migrateOutputValues turns the text outputs of previous versions into JSON strings,
+// a plain cast would fail for the ones that are not valid JSON
+func migrateOutputValues(connection *gorm.DB) error {
+	if !connection.Migrator().HasTable(&KeyValueOutput{}) {
+		return nil
+	}
+	columns, err := connection.Migrator().ColumnTypes(&KeyValueOutput{})
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if column.Name() == "value" && !strings.EqualFold(column.DatabaseTypeName(), "jsonb") {
+			log.Printf("Migrating output values from %s to jsonb", column.DatabaseTypeName())
+			return connection.Exec("ALTER TABLE key_value_outputs ALTER COLUMN value TYPE jsonb USING to_jsonb(value)").Error
+		}
+	}
+	return nil
+}
+
+// migrateStepColumn turns the current step of the executions of previous versions, which ran their steps in order,
+// into step states: the steps before it succeeded and it has the status of the execution.
+// The steps are chained by their order so the executions continue as they would have, then the column is dropped
+func migrateStepColumn(connection *gorm.DB) error {
+	if !connection.Migrator().HasColumn(&State{}, "step") {
+		return nil
+	}
+	log.Printf("Migrating current steps to step states")
+	return connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO step_dependencies (created_at, updated_at, step_id, depends_on)
+			SELECT now(), now(), s.id, p.name FROM steps s
+			JOIN steps p ON p.execution_id = s.execution_id AND p.step_order = s.step_order - 1 AND p.deleted_at IS NULL
+			WHERE s.deleted_at IS NULL AND NOT EXISTS (
+				SELECT 1 FROM step_dependencies d JOIN steps x ON x.id = d.step_id WHERE x.execution_id = s.execution_id
+			)`).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`INSERT INTO step_states (created_at, updated_at, state_id, name, status, attempt)
+			SELECT now(), now(), st.id, s.name, CASE WHEN s.step_order < c.step_order THEN ? ELSE st.status END, 1
+			FROM states st
+			JOIN steps c ON c.execution_id = st.execution_id AND c.name = st.step AND c.deleted_at IS NULL
+			JOIN steps s ON s.execution_id = st.execution_id AND s.step_order <= c.step_order AND s.deleted_at IS NULL
+			WHERE st.deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM step_states ss WHERE ss.state_id = st.id)`, SUCCESS).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&State{}, "step")
+	})
+}
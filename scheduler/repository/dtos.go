@@ -2,18 +2,57 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
-type SubmissionStepDTO struct {
+type RetryPolicyDTO struct {
+	MaxAttempts         uint     `json:"maxAttempts"`
+	InitialDelaySeconds uint     `json:"initialDelaySeconds"`
+	Multiplier          float64  `json:"multiplier"`
+	RetryableErrors     []string `json:"retryableErrors"`
+}
+
+func (r *RetryPolicyDTO) ToRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:         r.MaxAttempts,
+		InitialDelaySeconds: r.InitialDelaySeconds,
+		Multiplier:          r.Multiplier,
+		RetryableErrors:     strings.Join(r.RetryableErrors, ","),
+	}
+}
+
+// StepTemplateDTO is a step run on behalf of a step of the workflow,
+// either to undo it when the execution fails or once per item of a foreach step
+type StepTemplateDTO struct {
 	Service string            `json:"service"`
-	Name    string            `json:"name"`
 	Task    string            `json:"task"`
 	Input   map[string]string `json:"input"`
 }
 
-func (s *SubmissionStepDTO) ToStep(stepIndex int) Step {
+type SubmissionStepDTO struct {
+	Service   string            `json:"service"`
+	Name      string            `json:"name"`
+	Task      string            `json:"task"`
+	Input     map[string]string `json:"input"`
+	DependsOn []string          `json:"dependsOn"`
+	Retry     *RetryPolicyDTO   `json:"retry"`
+	// Overrides the timeout of the workflow for this step
+	TimeoutSeconds uint             `json:"timeoutSeconds"`
+	Compensate     *StepTemplateDTO `json:"compensate"`
+	// Step run once per item by a foreach step
+	Template *StepTemplateDTO `json:"template"`
+}
+
+// ToStep builds the step with the given dependencies, which are resolved by the submission
+// since a step without dependsOn implicitly depends on the previous one.
+// The default timeout is used when the step doesn't define its own
+func (s *SubmissionStepDTO) ToStep(stepIndex int, dependsOn []string, defaultTimeoutSeconds uint) Step {
 	inputs := make([]*KeyValueStep, len(s.Input))
 	i := 0
 	for k, v := range s.Input {
@@ -23,28 +62,185 @@ func (s *SubmissionStepDTO) ToStep(stepIndex int) Step {
 		}
 		i++
 	}
+	dependencies := make([]*StepDependency, len(dependsOn))
+	for j, d := range dependsOn {
+		dependencies[j] = &StepDependency{
+			DependsOn: d,
+		}
+	}
+	var retry *RetryPolicy
+	if s.Retry != nil {
+		retry = s.Retry.ToRetryPolicy()
+	}
+	timeoutSeconds := s.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = defaultTimeoutSeconds
+	}
 	return Step{
-		Service:   s.Service,
-		Name:      s.Name,
-		Task:      s.Task,
-		Inputs:    inputs,
-		StepOrder: stepIndex,
+		Service:        s.Service,
+		Name:           s.Name,
+		Task:           s.Task,
+		Inputs:         inputs,
+		StepOrder:      stepIndex,
+		Dependencies:   dependencies,
+		Retry:          retry,
+		TimeoutSeconds: timeoutSeconds,
+	}
+}
+
+// ToCompensationStep builds the step that compensates this one, nil if it has no compensation
+func (s *SubmissionStepDTO) ToCompensationStep(stepIndex int, defaultTimeoutSeconds uint) *Step {
+	if s.Compensate == nil {
+		return nil
+	}
+	inputs := make([]*KeyValueStep, 0, len(s.Compensate.Input))
+	for k, v := range s.Compensate.Input {
+		inputs = append(inputs, &KeyValueStep{
+			Key:   k,
+			Value: v,
+		})
+	}
+	return &Step{
+		Service:        s.Compensate.Service,
+		Name:           CompensationStepName(s.Name),
+		Task:           s.Compensate.Task,
+		Inputs:         inputs,
+		StepOrder:      stepIndex,
+		TimeoutSeconds: defaultTimeoutSeconds,
+		Phase:          COMPENSATION,
+		Compensates:    s.Name,
+	}
+}
+
+// ToTemplateStep builds the template of the items of this foreach step, nil if it has no template
+func (s *SubmissionStepDTO) ToTemplateStep(stepIndex int, defaultTimeoutSeconds uint) *Step {
+	if s.Template == nil {
+		return nil
+	}
+	inputs := make([]*KeyValueStep, 0, len(s.Template.Input))
+	for k, v := range s.Template.Input {
+		inputs = append(inputs, &KeyValueStep{
+			Key:   k,
+			Value: v,
+		})
+	}
+	return &Step{
+		Service:        s.Template.Service,
+		Name:           TemplateStepName(s.Name),
+		Task:           s.Template.Task,
+		Inputs:         inputs,
+		StepOrder:      stepIndex,
+		TimeoutSeconds: defaultTimeoutSeconds,
+		Phase:          ITEM,
+		Foreach:        s.Name,
+	}
+}
+
+// stepDependencies resolves the dependencies of every step. Steps without dependsOn depend on the previous step,
+// so linear workflows keep working, while an explicit empty list makes the step a root of the graph.
+// Fails if a dependency does not exist or if the dependencies have a cycle
+func stepDependencies(steps []SubmissionStepDTO) (map[string][]string, error) {
+	dependencies := make(map[string][]string)
+	for i, s := range steps {
+		if _, ok := dependencies[s.Name]; ok {
+			return nil, fmt.Errorf("duplicated step name: %s", s.Name)
+		}
+		if s.DependsOn == nil {
+			if i > 0 {
+				dependencies[s.Name] = []string{steps[i-1].Name}
+			} else {
+				dependencies[s.Name] = []string{}
+			}
+		} else {
+			dependencies[s.Name] = s.DependsOn
+		}
+	}
+	for name, dependsOn := range dependencies {
+		for _, d := range dependsOn {
+			if _, ok := dependencies[d]; !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %s", name, d)
+			}
+		}
 	}
+	// Kahn's algorithm, if not every step can be visited there is a cycle
+	pending := make(map[string]int)
+	for name, dependsOn := range dependencies {
+		pending[name] = len(dependsOn)
+	}
+	visited := 0
+	queue := make([]string, 0)
+	for name, count := range pending {
+		if count == 0 {
+			queue = append(queue, name)
+		}
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		visited++
+		for name, dependsOn := range dependencies {
+			for _, d := range dependsOn {
+				if d == current {
+					pending[name]--
+					if pending[name] == 0 {
+						queue = append(queue, name)
+					}
+				}
+			}
+		}
+	}
+	if visited != len(dependencies) {
+		return nil, fmt.Errorf("steps dependencies have a cycle")
+	}
+	return dependencies, nil
 }
 
 type ExecutionsParamsDTO struct {
-	CronDefinition string `json:"cronDefinition"`
-	Delayed        string `json:"delayed"`
+	CronDefinition     string `json:"cronDefinition"`
+	Delayed            string `json:"delayed"`
+	MaxDurationSeconds uint   `json:"maxDurationSeconds"`
+	Deadline           string `json:"deadline"` // RFC 3339 timestamp
 }
 
 type ExecutionSubmissionDTO struct {
-	WorkflowName  string              `json:"workflowName"`
-	WorkflowID    uint                `json:"workflowID"`
-	ExecutionUUID string              `json:"ExecutionUUID"`
-	Tags          []string            `json:"tags"`
-	Parameters    ExecutionsParamsDTO `json:"parameters"`
-	Arguments     map[string]string   `json:"args"`
-	Steps         []SubmissionStepDTO `json:"steps"`
+	WorkflowName  string   `json:"workflowName"`
+	WorkflowID    uint     `json:"workflowID"`
+	ExecutionUUID string   `json:"ExecutionUUID"`
+	Tags          []string `json:"tags"`
+	Priority      string   `json:"priority"` // high, normal or low, normal if empty
+	// Executions with the same concurrency key run at most the limit of service steps at a time
+	ConcurrencyKey   string              `json:"concurrencyKey"`
+	ConcurrencyLimit uint                `json:"concurrencyLimit"`
+	Parameters       ExecutionsParamsDTO `json:"parameters"`
+	Arguments        map[string]string   `json:"args"`
+	Steps            []SubmissionStepDTO `json:"steps"`
+	// Default timeout of every step of the workflow, 0 means no timeout
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// Steps run when the execution fails, after the compensations
+	OnFailure []SubmissionStepDTO `json:"onFailure"`
+	// Steps run when the execution ends, no matter how
+	Finally []SubmissionStepDTO `json:"finally"`
+}
+
+// phaseSteps builds the steps of a failure or finally phase, their dependencies are resolved within the phase
+func (e ExecutionSubmissionDTO) phaseSteps(phase string, submissionSteps []SubmissionStepDTO, firstIndex int) ([]*Step, error) {
+	dependencies, err := stepDependencies(submissionSteps)
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]*Step, 0, len(submissionSteps))
+	for i, s := range submissionSteps {
+		step := s.ToStep(firstIndex+i, dependencies[s.Name], e.TimeoutSeconds)
+		step.Phase = phase
+		steps = append(steps, &step)
+		if template := s.ToTemplateStep(firstIndex+i, e.TimeoutSeconds); template != nil {
+			if template.Service == "native" {
+				return nil, fmt.Errorf("native template not supported: %s", s.Name)
+			}
+			steps = append(steps, template)
+		}
+	}
+	return steps, nil
 }
 
 func (e ExecutionSubmissionDTO) ToExecution(status string) *Execution {
@@ -66,37 +262,69 @@ func (e ExecutionSubmissionDTO) ToExecution(status string) *Execution {
 		}
 
 	}
-
-	outputs := make([]*KeyValueOutput, 0)
-	arguments := make([]*KeyValueArgument, len(e.Arguments))
-	if e.Arguments != nil {
-		i := 0
-		for k, v := range e.Arguments {
-			arguments[i] = &KeyValueArgument{
-				Key:   k,
-				Value: v,
-			}
-			i++
+	if e.Parameters.MaxDurationSeconds > 0 {
+		params.MaxDurationSeconds = e.Parameters.MaxDurationSeconds
+		paramsEmpty = false
+	}
+	if e.Parameters.Deadline != "" {
+		deadline, err := time.Parse(time.RFC3339, e.Parameters.Deadline)
+		if err != nil {
+			log.Printf("Failed to parse deadline: %s\n", err)
+			return nil
 		}
+		params.Deadline = sql.NullTime{Time: deadline, Valid: true}
+		paramsEmpty = false
 	}
 
 	steps := make([]*Step, len(e.Steps))
 	if e.Steps == nil {
 		e.Steps = make([]SubmissionStepDTO, 0)
 	}
+	dependencies, err := stepDependencies(e.Steps)
+	if err != nil {
+		log.Printf("Invalid steps dependencies: %s\n", err)
+		return nil
+	}
 	for i, s := range e.Steps {
-		step := s.ToStep(i)
+		step := s.ToStep(i, dependencies[s.Name], e.TimeoutSeconds)
 		steps[i] = &step
 	}
 	if len(steps) <= 0 {
 		log.Printf("No steps provided, skipped\n")
 		return nil
 	}
-	state := State{
-		Step:      steps[0].Name,
-		Status:    status,
-		Outputs:   outputs,
-		Arguments: arguments,
+	for i, s := range e.Steps {
+		if compensation := s.ToCompensationStep(i, e.TimeoutSeconds); compensation != nil {
+			steps = append(steps, compensation)
+		}
+		if template := s.ToTemplateStep(i, e.TimeoutSeconds); template != nil {
+			// The items are handled on the service responses, native steps handle their own
+			if template.Service == "native" {
+				log.Printf("Native template not supported: %s\n", s.Name)
+				return nil
+			}
+			steps = append(steps, template)
+		}
+	}
+	onFailure, err := e.phaseSteps(ON_FAILURE, e.OnFailure, len(e.Steps))
+	if err != nil {
+		log.Printf("Invalid onFailure steps: %s\n", err)
+		return nil
+	}
+	finally, err := e.phaseSteps(FINALLY, e.Finally, len(e.Steps)+len(e.OnFailure))
+	if err != nil {
+		log.Printf("Invalid finally steps: %s\n", err)
+		return nil
+	}
+	steps = append(steps, onFailure...)
+	steps = append(steps, finally...)
+	names := make(map[string]bool)
+	for _, s := range steps {
+		if names[s.Name] {
+			log.Printf("Duplicated step name: %s\n", s.Name)
+			return nil
+		}
+		names[s.Name] = true
 	}
 	tags := make([]*Tags, len(e.Tags))
 	for i, t := range e.Tags {
@@ -107,29 +335,61 @@ func (e ExecutionSubmissionDTO) ToExecution(status string) *Execution {
 	if paramsEmpty {
 		params = nil
 	}
+	priority := e.Priority
+	if priority == "" {
+		priority = NORMAL_PRIORITY
+	}
+	if !slices.Contains(Priorities, priority) {
+		log.Printf("Invalid priority: %s\n", priority)
+		return nil
+	}
+	state := NewState(status, steps, e.Arguments)
+	state.Priority = priority
+	if e.ConcurrencyKey != "" {
+		state.ConcurrencyKey = e.ConcurrencyKey
+		state.ConcurrencyLimit = e.ConcurrencyLimit
+	}
 	return &Execution{
 		WorkflowID:    e.WorkflowID,
 		Tags:          tags,
 		Params:        params,
 		Steps:         steps,
-		State:         &state,
+		State:         state,
 		ExecutionUUID: e.ExecutionUUID,
 	}
 }
 
 type ExecutionStepDTO struct {
-	Service     string            `json:"service"`
-	Name        string            `json:"name"`
-	Task        string            `json:"task"`
-	Input       map[string]string `json:"input"`
-	ExecutionID uint              `json:"execution_id"`
-	StepOrder   int               `json:"step_order"`
+	Service        string            `json:"service"`
+	Name           string            `json:"name"`
+	Task           string            `json:"task"`
+	Input          map[string]string `json:"input"`
+	ExecutionID    uint              `json:"execution_id"`
+	StepOrder      int               `json:"step_order"`
+	TimeoutSeconds uint              `json:"timeout_seconds"`
 }
 
 type ExecutionStateResponseDTO struct {
-	Step    string                 `json:"step"`
+	Step    string                 `json:"step"` // Current step, kept for the clients from before steps ran in parallel
+	Steps   map[string]string      `json:"steps"`
 	Status  string                 `json:"status"`
 	Outputs map[string]interface{} `json:"outputs"`
+	Errors  map[string]JSONValue   `json:"errors"`
+}
+
+type StepRunResponseDTO struct {
+	Step         string          `json:"step"`
+	Attempt      uint            `json:"attempt"`
+	Status       string          `json:"status"`
+	Inputs       json.RawMessage `json:"inputs"`
+	Response     json.RawMessage `json:"response"`
+	DispatchedAt *time.Time      `json:"dispatchedAt"`
+	StartedAt    *time.Time      `json:"startedAt"`
+	FinishedAt   *time.Time      `json:"finishedAt"`
+}
+
+type RetryExecutionDTO struct {
+	Arguments map[string]string `json:"args"`
 }
 
 type CancelTagsDTO struct {
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestExecutionSubmissionDTO_ToExecution(t *testing.T) {
@@ -57,25 +58,28 @@ func TestExecutionSubmissionDTO_ToExecution(t *testing.T) {
 				ExecutionUUID: "aaaaa5",
 				Tags:          []*Tags{{Tag: "test"}, {Tag: "test2"}},
 				State: &State{
-					Step:      "TestName",
-					Status:    PENDING,
-					Outputs:   make([]*KeyValueOutput, 0),
-					Arguments: []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
+					Status:     PENDING,
+					Priority:   NORMAL_PRIORITY,
+					StepStates: []*StepState{{Name: "TestName", Status: PENDING, Attempt: 1}},
+					Outputs:    make([]*KeyValueOutput, 0),
+					Arguments:  []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
 				},
 				Steps: []*Step{
 					{
-						Name:      "TestName",
-						Service:   "TestService",
-						Task:      "TestTask",
-						StepOrder: 0,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Name:         "TestName",
+						Service:      "TestService",
+						Task:         "TestTask",
+						StepOrder:    0,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Dependencies: []*StepDependency{},
 					},
 					{
-						Name:      "TestName2",
-						Service:   "TestService2",
-						Task:      "TestTask2",
-						StepOrder: 1,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Name:         "TestName2",
+						Service:      "TestService2",
+						Task:         "TestTask2",
+						StepOrder:    1,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Dependencies: []*StepDependency{{DependsOn: "TestName"}},
 					},
 				},
 				Params: &ExecutionParams{
@@ -115,25 +119,28 @@ func TestExecutionSubmissionDTO_ToExecution(t *testing.T) {
 				ExecutionUUID: "aaaaa5",
 				Tags:          []*Tags{{Tag: "test"}, {Tag: "test2"}},
 				State: &State{
-					Step:      "TestName",
-					Status:    EXECUTING,
-					Outputs:   make([]*KeyValueOutput, 0),
-					Arguments: []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
+					Status:     EXECUTING,
+					Priority:   NORMAL_PRIORITY,
+					StepStates: []*StepState{{Name: "TestName", Status: PENDING, Attempt: 1}},
+					Outputs:    make([]*KeyValueOutput, 0),
+					Arguments:  []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
 				},
 				Steps: []*Step{
 					{
-						Name:      "TestName",
-						Service:   "TestService",
-						Task:      "TestTask",
-						StepOrder: 0,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Name:         "TestName",
+						Service:      "TestService",
+						Task:         "TestTask",
+						StepOrder:    0,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Dependencies: []*StepDependency{},
 					},
 					{
-						Name:      "TestName2",
-						Service:   "TestService2",
-						Task:      "TestTask2",
-						StepOrder: 1,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Name:         "TestName2",
+						Service:      "TestService2",
+						Task:         "TestTask2",
+						StepOrder:    1,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Dependencies: []*StepDependency{{DependsOn: "TestName"}},
 					},
 				},
 				Params: &ExecutionParams{
@@ -172,25 +179,28 @@ func TestExecutionSubmissionDTO_ToExecution(t *testing.T) {
 				ExecutionUUID: "aaaaa5",
 				Tags:          []*Tags{{Tag: "test"}, {Tag: "test2"}},
 				State: &State{
-					Step:      "TestName",
-					Status:    EXECUTING,
-					Outputs:   make([]*KeyValueOutput, 0),
-					Arguments: []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
+					Status:     EXECUTING,
+					Priority:   NORMAL_PRIORITY,
+					StepStates: []*StepState{{Name: "TestName", Status: PENDING, Attempt: 1}},
+					Outputs:    make([]*KeyValueOutput, 0),
+					Arguments:  []*KeyValueArgument{{Key: "KeyTest", Value: "ValueTest"}},
 				},
 				Steps: []*Step{
 					{
-						Name:      "TestName",
-						Service:   "TestService",
-						Task:      "TestTask",
-						StepOrder: 0,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Name:         "TestName",
+						Service:      "TestService",
+						Task:         "TestTask",
+						StepOrder:    0,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest", Value: "ValueInputTest"}},
+						Dependencies: []*StepDependency{},
 					},
 					{
-						Name:      "TestName2",
-						Service:   "TestService2",
-						Task:      "TestTask2",
-						StepOrder: 1,
-						Inputs:    []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Name:         "TestName2",
+						Service:      "TestService2",
+						Task:         "TestTask2",
+						StepOrder:    1,
+						Inputs:       []*KeyValueStep{{Key: "KeyInputTest2", Value: "ValueInputTest2"}},
+						Dependencies: []*StepDependency{{DependsOn: "TestName"}},
 					},
 				},
 				Params: nil,
@@ -214,3 +224,262 @@ func TestExecutionSubmissionDTO_ToExecution(t *testing.T) {
 		})
 	}
 }
+
+func TestExecutionSubmissionDTO_ToExecution_DependsOn(t *testing.T) {
+	e := ExecutionSubmissionDTO{
+		ExecutionUUID: "aaaaa5",
+		Steps: []SubmissionStepDTO{
+			{Name: "download1", Service: "s3_service", Task: "download", DependsOn: []string{}},
+			{Name: "download2", Service: "s3_service", Task: "download", DependsOn: []string{}},
+			{Name: "process", Service: "ubuntu_service", Task: "bash", DependsOn: []string{"download1", "download2"}},
+			{Name: "upload", Service: "s3_service", Task: "upload"},
+		},
+	}
+	execution := e.ToExecution(PENDING)
+	if execution == nil {
+		t.Fatalf("ToExecution() = nil, want execution")
+	}
+	wantStates := []*StepState{{Name: "download1", Status: PENDING, Attempt: 1}, {Name: "download2", Status: PENDING, Attempt: 1}}
+	if !reflect.DeepEqual(execution.State.StepStates, wantStates) {
+		t.Errorf("StepStates = %v, want %v", execution.State.StepStates, wantStates)
+	}
+	wantDependencies := []*StepDependency{{DependsOn: "download1"}, {DependsOn: "download2"}}
+	if !reflect.DeepEqual(execution.Steps[2].Dependencies, wantDependencies) {
+		t.Errorf("process dependencies = %v, want %v", execution.Steps[2].Dependencies, wantDependencies)
+	}
+	wantDependencies = []*StepDependency{{DependsOn: "process"}}
+	if !reflect.DeepEqual(execution.Steps[3].Dependencies, wantDependencies) {
+		t.Errorf("upload dependencies = %v, want %v", execution.Steps[3].Dependencies, wantDependencies)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_InvalidDependsOn(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []SubmissionStepDTO
+	}{
+		{
+			name: "Unknown step",
+			steps: []SubmissionStepDTO{
+				{Name: "first"},
+				{Name: "second", DependsOn: []string{"missing"}},
+			},
+		},
+		{
+			name: "Cycle",
+			steps: []SubmissionStepDTO{
+				{Name: "first", DependsOn: []string{"second"}},
+				{Name: "second", DependsOn: []string{"first"}},
+			},
+		},
+		{
+			name: "Duplicated name",
+			steps: []SubmissionStepDTO{
+				{Name: "first"},
+				{Name: "first"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := ExecutionSubmissionDTO{Steps: tt.steps}
+			if got := e.ToExecution(PENDING); got != nil {
+				t.Errorf("ToExecution() = %v, want nil", got)
+			}
+		})
+	}
+}
+
+func TestSubmissionStepDTO_ToStep_Retry(t *testing.T) {
+	s := SubmissionStepDTO{
+		Name: "flaky",
+		Retry: &RetryPolicyDTO{
+			MaxAttempts:         3,
+			InitialDelaySeconds: 5,
+			Multiplier:          2,
+			RetryableErrors:     []string{"network", "timeout"},
+		},
+	}
+	step := s.ToStep(0, []string{}, 0)
+	want := &RetryPolicy{MaxAttempts: 3, InitialDelaySeconds: 5, Multiplier: 2, RetryableErrors: "network,timeout"}
+	if !reflect.DeepEqual(step.Retry, want) {
+		t.Errorf("ToStep().Retry = %v, want %v", step.Retry, want)
+	}
+}
+
+func TestSubmissionStepDTO_ToStep_Timeout(t *testing.T) {
+	withTimeout := SubmissionStepDTO{Name: "slow", TimeoutSeconds: 30}
+	if step := withTimeout.ToStep(0, []string{}, 10); step.TimeoutSeconds != 30 {
+		t.Errorf("ToStep().TimeoutSeconds = %d, want 30", step.TimeoutSeconds)
+	}
+	withoutTimeout := SubmissionStepDTO{Name: "fast"}
+	if step := withoutTimeout.ToStep(0, []string{}, 10); step.TimeoutSeconds != 10 {
+		t.Errorf("ToStep().TimeoutSeconds = %d, want 10", step.TimeoutSeconds)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_Compensate(t *testing.T) {
+	e := ExecutionSubmissionDTO{
+		Steps: []SubmissionStepDTO{
+			{
+				Name:    "upload",
+				Service: "s3_service",
+				Task:    "upload",
+				Compensate: &StepTemplateDTO{
+					Service: "s3_service",
+					Task:    "delete",
+					Input:   map[string]string{"s3_key": "upload.key"},
+				},
+			},
+			{Name: "notify", Service: "echo_service", Task: "echo"},
+		},
+		TimeoutSeconds: 10,
+	}
+	execution := e.ToExecution(PENDING)
+	if execution == nil {
+		t.Fatalf("ToExecution() = nil, want execution")
+	}
+	if len(execution.Steps) != 3 {
+		t.Fatalf("Steps = %v, want the compensation after the workflow steps", stepNames(execution.Steps))
+	}
+	want := &Step{
+		Service:        "s3_service",
+		Name:           "upload:compensate",
+		Task:           "delete",
+		Inputs:         []*KeyValueStep{{Key: "s3_key", Value: "upload.key"}},
+		StepOrder:      0,
+		TimeoutSeconds: 10,
+		Phase:          COMPENSATION,
+		Compensates:    "upload",
+	}
+	if !reflect.DeepEqual(execution.Steps[2], want) {
+		t.Errorf("compensation = %v, want %v", execution.Steps[2], want)
+	}
+	wantStates := []*StepState{{Name: "upload", Status: PENDING, Attempt: 1}}
+	if !reflect.DeepEqual(execution.State.StepStates, wantStates) {
+		t.Errorf("StepStates = %v, want %v", execution.State.StepStates, wantStates)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_OnFailureAndFinally(t *testing.T) {
+	e := ExecutionSubmissionDTO{
+		Steps: []SubmissionStepDTO{
+			{Name: "process", Service: "ubuntu_service", Task: "bash"},
+		},
+		OnFailure: []SubmissionStepDTO{
+			{Name: "notify", Service: "echo_service", Task: "echo", Input: map[string]string{"msg": "$error.msg"}},
+		},
+		Finally: []SubmissionStepDTO{
+			{Name: "cleanup", Service: "ubuntu_service", Task: "bash"},
+			{Name: "report", Service: "echo_service", Task: "echo"},
+		},
+	}
+	execution := e.ToExecution(PENDING)
+	if execution == nil {
+		t.Fatalf("ToExecution() = nil, want execution")
+	}
+	want := map[string]string{"process": "", "notify": ON_FAILURE, "cleanup": FINALLY, "report": FINALLY}
+	if len(execution.Steps) != len(want) {
+		t.Fatalf("Steps = %v, want %v", stepNames(execution.Steps), want)
+	}
+	for _, s := range execution.Steps {
+		if s.Phase != want[s.Name] {
+			t.Errorf("%s phase = %v, want %v", s.Name, s.Phase, want[s.Name])
+		}
+	}
+	if roots := stepNames(execution.PhaseRootSteps(FINALLY)); len(roots) != 1 || roots[0] != "cleanup" {
+		t.Errorf("PhaseRootSteps(FINALLY) = %v, want [cleanup]", roots)
+	}
+	if report := execution.GetStep("report"); !report.DependsOn("cleanup") {
+		t.Errorf("report dependencies = %v, want cleanup", report.Dependencies)
+	}
+	wantStates := []*StepState{{Name: "process", Status: PENDING, Attempt: 1}}
+	if !reflect.DeepEqual(execution.State.StepStates, wantStates) {
+		t.Errorf("StepStates = %v, want %v", execution.State.StepStates, wantStates)
+	}
+
+	e.Finally = []SubmissionStepDTO{{Name: "process"}}
+	if got := e.ToExecution(PENDING); got != nil {
+		t.Errorf("ToExecution() with duplicated names = %v, want nil", got)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_Template(t *testing.T) {
+	e := ExecutionSubmissionDTO{
+		Steps: []SubmissionStepDTO{
+			{
+				Name:    "files",
+				Service: "native",
+				Task:    "foreach",
+				Input:   map[string]string{"items": "$args.keys", "concurrency": "2"},
+				Template: &StepTemplateDTO{
+					Service: "s3_service",
+					Task:    "download",
+					Input:   map[string]string{"s3_key": "$item"},
+				},
+			},
+		},
+	}
+	execution := e.ToExecution(PENDING)
+	if execution == nil {
+		t.Fatalf("ToExecution() = nil, want execution")
+	}
+	template := execution.GetStep(TemplateStepName("files"))
+	if template == nil || template.Phase != ITEM || template.Foreach != "files" || template.Service != "s3_service" {
+		t.Errorf("template = %v, want the item template of files", template)
+	}
+	if roots := stepNames(execution.RootSteps()); len(roots) != 1 || roots[0] != "files" {
+		t.Errorf("RootSteps() = %v, want [files]", roots)
+	}
+
+	e.Steps[0].Template.Service = "native"
+	if got := e.ToExecution(PENDING); got != nil {
+		t.Errorf("ToExecution() with a native template = %v, want nil", got)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_Deadline(t *testing.T) {
+	e := ExecutionSubmissionDTO{
+		Parameters: ExecutionsParamsDTO{MaxDurationSeconds: 3600, Deadline: "2024-11-20T10:00:00Z"},
+		Steps:      []SubmissionStepDTO{{Name: "nightly"}},
+	}
+	execution := e.ToExecution(PENDING)
+	if execution.Params == nil || execution.Params.MaxDurationSeconds != 3600 {
+		t.Fatalf("ToExecution().Params = %v, want max duration of 3600 seconds", execution.Params)
+	}
+	if want := time.Date(2024, 11, 20, 10, 0, 0, 0, time.UTC); !execution.Params.Deadline.Time.Equal(want) {
+		t.Errorf("ToExecution().Params.Deadline = %v, want %v", execution.Params.Deadline.Time, want)
+	}
+	e.Parameters.Deadline = "tomorrow"
+	if execution := e.ToExecution(PENDING); execution != nil {
+		t.Errorf("ToExecution() = %v, want nil for an invalid deadline", execution)
+	}
+}
+
+func TestExecutionSubmissionDTO_ToExecution_Priority(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority string
+		want     string
+	}{
+		{name: "Default", priority: "", want: NORMAL_PRIORITY},
+		{name: "High", priority: "high", want: HIGH_PRIORITY},
+		{name: "Low", priority: "low", want: LOW_PRIORITY},
+		{name: "Invalid", priority: "urgent", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := ExecutionSubmissionDTO{Priority: tt.priority, Steps: []SubmissionStepDTO{{Name: "step"}}}
+			execution := e.ToExecution(PENDING)
+			if tt.want == "" {
+				if execution != nil {
+					t.Errorf("ToExecution() = %v, want nil", execution)
+				}
+				return
+			}
+			if execution.State.Priority != tt.want {
+				t.Errorf("ToExecution().State.Priority = %v, want %v", execution.State.Priority, tt.want)
+			}
+		})
+	}
+}
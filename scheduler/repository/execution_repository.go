@@ -2,17 +2,76 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sort"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrConflict is returned when a state is updated after another writer updated it since it was loaded
+var ErrConflict = errors.New("state was updated concurrently")
+
 type ExecutionRepository struct {
 	db *gorm.DB
+	// conflict is set when an update of the transaction lost against another writer
+	conflict bool
 }
 
 func NewExecutionRepository(db *gorm.DB) *ExecutionRepository {
-	return &ExecutionRepository{db}
+	return &ExecutionRepository{db: db}
+}
+
+// Transaction runs fn with a repository whose changes are committed together, they are rolled back if fn returns an error.
+// They are also rolled back with ErrConflict if a state update conflicted, so that the caller reloads and retries
+func (r *ExecutionRepository) Transaction(ctx context.Context, fn func(tx *ExecutionRepository) error) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		repository := &ExecutionRepository{db: tx}
+		err := fn(repository)
+		if err == nil && repository.conflict {
+			return ErrConflict
+		}
+		return err
+	})
+}
+
+// AddOutboxMessage stores a message to be published by the relay, with the changes of the current transaction
+func (r *ExecutionRepository) AddOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	tx := r.db.WithContext(ctx).Create(message)
+	if tx.Error != nil {
+		log.Printf("Failed to add outbox message: %v", tx.Error)
+	}
+	return tx.Error
+}
+
+// PublishOutbox publishes up to limit messages of the outbox in order and deletes the ones that were published.
+// Messages locked by another instance are skipped, and publishing stops at the first failure so that it is retried.
+// Returns how many messages were published
+func (r *ExecutionRepository) PublishOutbox(ctx context.Context, limit int, publish func(message *OutboxMessage) error) (int, error) {
+	published := 0
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var messages []*OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Order("id").Limit(limit).Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			err = publish(message)
+			if err != nil {
+				log.Printf("Failed to publish outbox message %d: %v", message.ID, err)
+				return nil
+			}
+			err = tx.Unscoped().Delete(message).Error
+			if err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	return published, err
 }
 
 func (r *ExecutionRepository) CreateExecution(ctx context.Context, execution *Execution) uint {
@@ -25,7 +84,7 @@ func (r *ExecutionRepository) CreateExecution(ctx context.Context, execution *Ex
 
 func (r *ExecutionRepository) GetExecutionById(ctx context.Context, id uint) *Execution {
 	execution := Execution{}
-	tx := r.db.WithContext(ctx).Preload("State").Preload("Steps").Preload("Steps.Inputs").Preload("State.Outputs").First(&execution, id)
+	tx := r.db.WithContext(ctx).Preload("State").Preload("State.StepStates").Preload("Steps").Preload("Steps.Inputs").Preload("Steps.Dependencies").Preload("Steps.Retry").Preload("State.Outputs").Preload("State.Arguments").First(&execution, id)
 	if tx.Error != nil {
 		log.Printf("Failed to get execution: %v", tx.Error)
 	}
@@ -33,7 +92,7 @@ func (r *ExecutionRepository) GetExecutionById(ctx context.Context, id uint) *Ex
 }
 func (r *ExecutionRepository) GetExecutionByUUID(ctx context.Context, uuid string) *Execution {
 	execution := Execution{}
-	tx := r.db.WithContext(ctx).Preload("State").Preload("Steps").Preload("State.Outputs").Where("execution_uuid = ?", uuid).First(&execution)
+	tx := r.db.WithContext(ctx).Preload("State").Preload("State.StepStates").Preload("Steps").Preload("State.Outputs").Where("execution_uuid = ?", uuid).First(&execution)
 	if tx.Error != nil {
 		log.Printf("Failed to get execution: %v", tx.Error)
 	}
@@ -42,7 +101,7 @@ func (r *ExecutionRepository) GetExecutionByUUID(ctx context.Context, uuid strin
 
 func (r *ExecutionRepository) GetExecutionsByJobID(ctx context.Context, jobID string) []*Execution {
 	var executions []Execution
-	tx := r.db.WithContext(ctx).Preload("State").Preload("Steps").Preload("State.Outputs").Where("job_id = ?", jobID).Find(&executions)
+	tx := r.db.WithContext(ctx).Preload("State").Preload("State.StepStates").Preload("Steps").Preload("State.Outputs").Where("job_id = ?", jobID).Find(&executions)
 	if tx.Error != nil {
 		log.Printf("Failed to get executions: %v", tx.Error)
 	}
@@ -53,16 +112,313 @@ func (r *ExecutionRepository) GetExecutionsByJobID(ctx context.Context, jobID st
 	return output
 }
 
-func (r *ExecutionRepository) UpdateState(ctx context.Context, state *State) {
-	tx := r.db.WithContext(ctx).Save(state)
+// UpdateState saves the state if nobody updated it since it was loaded, it returns ErrConflict otherwise.
+// The version of the state is increased with every update
+func (r *ExecutionRepository) UpdateState(ctx context.Context, state *State) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&State{}).Where("id = ? AND version = ?", state.ID, state.Version).
+			UpdateColumn("version", gorm.Expr("version + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+		state.Version++
+		err := tx.Save(state).Error
+		if err != nil {
+			state.Version--
+		}
+		return err
+	})
+	if errors.Is(err, ErrConflict) {
+		r.conflict = true
+		log.Printf("Conflict updating state of execution %d at version %d", state.ExecutionID, state.Version)
+	} else if err != nil {
+		log.Printf("Failed to update execution: %v", err)
+	}
+	return err
+}
+
+// DeleteOutput removes an output of the execution, like the error of a failed execution that is retried
+func (r *ExecutionRepository) DeleteOutput(ctx context.Context, output *KeyValueOutput) {
+	tx := r.db.WithContext(ctx).Delete(output)
+	if tx.Error != nil {
+		log.Printf("Failed to delete output: %v", tx.Error)
+	}
+}
+
+// GetStepNames returns the names of the steps of the execution
+func (r *ExecutionRepository) GetStepNames(ctx context.Context, executionID uint) []string {
+	var names []string
+	tx := r.db.WithContext(ctx).Model(&Step{}).Where("execution_id = ?", executionID).Pluck("name", &names)
+	if tx.Error != nil {
+		log.Printf("Failed to get step names: %v", tx.Error)
+	}
+	return names
+}
+
+// DeleteStepState removes the state of a step, like the ones that run again when a failed execution is retried
+func (r *ExecutionRepository) DeleteStepState(ctx context.Context, stepState *StepState) {
+	tx := r.db.WithContext(ctx).Delete(stepState)
+	if tx.Error != nil {
+		log.Printf("Failed to delete step state: %v", tx.Error)
+	}
+}
+
+func (r *ExecutionRepository) UpdateArgument(ctx context.Context, argument *KeyValueArgument) {
+	tx := r.db.WithContext(ctx).Save(argument)
+	if tx.Error != nil {
+		log.Printf("Failed to update argument: %v", tx.Error)
+	}
+}
+
+// UpdateStepState saves a single step state, so concurrent steps of the same execution don't overwrite each other
+func (r *ExecutionRepository) UpdateStepState(ctx context.Context, stepState *StepState) {
+	tx := r.db.WithContext(ctx).Save(stepState)
+	if tx.Error != nil {
+		log.Printf("Failed to update step state: %v", tx.Error)
+	}
+}
+
+// ClaimStepDispatch atomically takes the dispatch of an executing step so that only one response of it is handled.
+// Returns false if the step is no longer executing that dispatch, like for stale or duplicate responses
+func (r *ExecutionRepository) ClaimStepDispatch(ctx context.Context, stepStateID uint, dispatchID string) bool {
+	tx := r.db.WithContext(ctx).Model(&StepState{}).
+		Where("id = ? AND status = ? AND dispatch_id = ?", stepStateID, EXECUTING, dispatchID).
+		Update("dispatch_id", "")
+	if tx.Error != nil {
+		log.Printf("Failed to claim step dispatch: %v", tx.Error)
+		return false
+	}
+	return tx.RowsAffected == 1
+}
+
+// GetStatesWithTimedOutSteps returns the states that have at least one executing step whose timeout is before the given time
+func (r *ExecutionRepository) GetStatesWithTimedOutSteps(ctx context.Context, now time.Time) []*State {
+	var states []*State
+	tx := r.db.WithContext(ctx).Preload("StepStates").
+		Where("id IN (?)", r.db.Model(&StepState{}).Select("state_id").Where("status = ? AND timeout_at < ?", EXECUTING, now)).
+		Find(&states)
+	if tx.Error != nil {
+		log.Printf("Failed to get states: %v", tx.Error)
+	}
+	return states
+}
+
+// GetStatesWithDueRetries returns the running states that have at least one retrying step whose retry is before the given time
+func (r *ExecutionRepository) GetStatesWithDueRetries(ctx context.Context, now time.Time) []*State {
+	var states []*State
+	tx := r.db.WithContext(ctx).Preload("StepStates").
+		Where("id IN (?)", r.db.Model(&StepState{}).Select("state_id").Where("status = ? AND retry_at <= ?", RETRYING, now)).
+		Where("status NOT IN ?", []string{SUCCESS, FAILED, CANCELLED, TIMED_OUT, COMPENSATED, COMPENSATION_FAILED}).
+		Find(&states)
+	if tx.Error != nil {
+		log.Printf("Failed to get states: %v", tx.Error)
+	}
+	return states
+}
+
+// GetStatesWithDueWakes returns the running states that have at least one waiting step whose wake up is before the given time
+func (r *ExecutionRepository) GetStatesWithDueWakes(ctx context.Context, now time.Time) []*State {
+	var states []*State
+	tx := r.db.WithContext(ctx).Preload("StepStates").
+		Where("id IN (?)", r.db.Model(&StepState{}).Select("state_id").Where("status = ? AND wake_at <= ?", WAITING, now)).
+		Where("status NOT IN ?", []string{SUCCESS, FAILED, CANCELLED, TIMED_OUT, COMPENSATED, COMPENSATION_FAILED}).
+		Find(&states)
+	if tx.Error != nil {
+		log.Printf("Failed to get states: %v", tx.Error)
+	}
+	return states
+}
+
+// AcquireConcurrency gives the step a lease of each of the keys, unless one of them reached its limit.
+// Returns the first key that reached its limit, empty if the leases were acquired. The keys are locked
+// until the transaction ends so that concurrent steps don't exceed the limits
+func (r *ExecutionRepository) AcquireConcurrency(ctx context.Context, stepStateID uint, limits map[string]uint) (string, error) {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	// Locked in order, so that steps sharing keys don't deadlock
+	sort.Strings(keys)
+	full := ""
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, key := range keys {
+			err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", key).Error
+			if err != nil {
+				return err
+			}
+			var leases int64
+			err = tx.Model(&ConcurrencyLease{}).Where("key = ? AND step_state_id <> ?", key, stepStateID).Count(&leases).Error
+			if err != nil {
+				return err
+			}
+			if leases >= int64(limits[key]) {
+				full = key
+				return nil
+			}
+		}
+		for _, key := range keys {
+			err := tx.Where("key = ? AND step_state_id = ?", key, stepStateID).
+				FirstOrCreate(&ConcurrencyLease{Key: key, StepStateID: stepStateID}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to acquire concurrency: %v", err)
+	}
+	return full, err
+}
+
+// ReleaseConcurrency deletes the leases of the step, returns the sorted keys they were of
+func (r *ExecutionRepository) ReleaseConcurrency(ctx context.Context, stepStateID uint) []string {
+	var leases []*ConcurrencyLease
+	tx := r.db.WithContext(ctx).Unscoped().Clauses(clause.Returning{}).Where("step_state_id = ?", stepStateID).Delete(&leases)
+	if tx.Error != nil {
+		log.Printf("Failed to release concurrency: %v", tx.Error)
+	}
+	keys := make([]string, len(leases))
+	for i, lease := range leases {
+		keys[i] = lease.Key
+	}
+	// Sorted like when acquiring, so that steps sharing keys don't deadlock
+	sort.Strings(keys)
+	return keys
+}
+
+// QueueStep holds a step until a lease of its key is released
+func (r *ExecutionRepository) QueueStep(ctx context.Context, queued *QueuedStep) error {
+	tx := r.db.WithContext(ctx).Create(queued)
+	if tx.Error != nil {
+		log.Printf("Failed to queue step: %v", tx.Error)
+	}
+	return tx.Error
+}
+
+// PopQueuedStep removes the step that has been waiting the longest for the key from the queue, nil if there is none.
+// The key is locked like when acquiring it, so that a step queued concurrently is found once it is committed
+func (r *ExecutionRepository) PopQueuedStep(ctx context.Context, key string) *QueuedStep {
+	tx := r.db.WithContext(ctx).Exec("SELECT pg_advisory_xact_lock(hashtext(?))", key)
+	if tx.Error != nil {
+		log.Printf("Failed to lock concurrency key: %v", tx.Error)
+		return nil
+	}
+	var queued []*QueuedStep
+	tx = r.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("key = ?", key).Order("id").Limit(1).Find(&queued)
+	if tx.Error != nil || len(queued) == 0 {
+		if tx.Error != nil {
+			log.Printf("Failed to get queued step: %v", tx.Error)
+		}
+		return nil
+	}
+	tx = r.db.WithContext(ctx).Unscoped().Delete(queued[0])
+	if tx.Error != nil {
+		log.Printf("Failed to remove queued step: %v", tx.Error)
+		return nil
+	}
+	return queued[0]
+}
+
+// DeleteQueuedSteps removes the steps of the execution from the queue, like when it is cancelled
+func (r *ExecutionRepository) DeleteQueuedSteps(ctx context.Context, executionID uint) {
+	tx := r.db.WithContext(ctx).Unscoped().Where("execution_id = ?", executionID).Delete(&QueuedStep{})
+	if tx.Error != nil {
+		log.Printf("Failed to delete queued steps: %v", tx.Error)
+	}
+}
+
+// GetStatesPastDeadline returns the states of the unfinished executions whose deadline passed
+func (r *ExecutionRepository) GetStatesPastDeadline(ctx context.Context, now time.Time) []*State {
+	var states []*State
+	tx := r.db.WithContext(ctx).
+		Where("deadline_at < ? AND status NOT IN ?", now, []string{SUCCESS, FAILED, CANCELLED, TIMED_OUT, COMPENSATED, COMPENSATION_FAILED}).
+		Find(&states)
+	if tx.Error != nil {
+		log.Printf("Failed to get states: %v", tx.Error)
+	}
+	return states
+}
+
+// GetLatestWorkflowExecution returns the last execution submitted for the workflow with its steps, nil if there is none.
+// Executions started by subworkflow steps are not submissions and are left out
+func (r *ExecutionRepository) GetLatestWorkflowExecution(ctx context.Context, workflowID uint) *Execution {
+	var executions []*Execution
+	tx := r.db.WithContext(ctx).Preload("Steps").Preload("Steps.Inputs").Preload("Steps.Dependencies").Preload("Steps.Retry").
+		Where("workflow_id = ? AND parent_execution_id = 0", workflowID).Order("id desc").Limit(1).Find(&executions)
+	if tx.Error != nil {
+		log.Printf("Failed to get workflow execution: %v", tx.Error)
+	}
+	if len(executions) == 0 {
+		return nil
+	}
+	return executions[0]
+}
+
+// GetWorkflowLineage returns the workflow of the execution followed by the ones of the executions that started it
+// as a subworkflow, up to the submitted one
+func (r *ExecutionRepository) GetWorkflowLineage(ctx context.Context, executionID uint) []uint {
+	workflowIDs := make([]uint, 0)
+	for executionID != 0 {
+		execution := Execution{}
+		tx := r.db.WithContext(ctx).Select("id", "workflow_id", "parent_execution_id").First(&execution, executionID)
+		if tx.Error != nil {
+			log.Printf("Failed to get execution: %v", tx.Error)
+			break
+		}
+		workflowIDs = append(workflowIDs, execution.WorkflowID)
+		executionID = execution.ParentExecutionID
+	}
+	return workflowIDs
+}
+
+// GetChildExecutions returns the executions started by the subworkflow steps of the execution
+func (r *ExecutionRepository) GetChildExecutions(ctx context.Context, parentExecutionID uint) []*Execution {
+	var executions []*Execution
+	tx := r.db.WithContext(ctx).Preload("State").Where("parent_execution_id = ?", parentExecutionID).Find(&executions)
+	if tx.Error != nil {
+		log.Printf("Failed to get child executions: %v", tx.Error)
+	}
+	return executions
+}
+
+func (r *ExecutionRepository) SaveStepRun(ctx context.Context, run *StepRun) {
+	tx := r.db.WithContext(ctx).Save(run)
+	if tx.Error != nil {
+		log.Printf("Failed to save step run: %v", tx.Error)
+	}
+}
+
+// GetLatestStepRun returns the last dispatch of the step, nil if it was never dispatched
+func (r *ExecutionRepository) GetLatestStepRun(ctx context.Context, executionID uint, stepName string) *StepRun {
+	var runs []*StepRun
+	tx := r.db.WithContext(ctx).Where("execution_id = ? AND step_name = ?", executionID, stepName).Order("id desc").Limit(1).Find(&runs)
+	if tx.Error != nil {
+		log.Printf("Failed to get step run: %v", tx.Error)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	return runs[0]
+}
+
+// GetStepRuns returns every dispatch of the steps of the execution in the order they were made
+func (r *ExecutionRepository) GetStepRuns(ctx context.Context, executionID uint) []*StepRun {
+	var runs []*StepRun
+	tx := r.db.WithContext(ctx).Where("execution_id = ?", executionID).Order("id").Find(&runs)
 	if tx.Error != nil {
-		log.Printf("Failed to update execution: %v", tx.Error)
+		log.Printf("Failed to get step runs: %v", tx.Error)
 	}
+	return runs
 }
 
 func (r *ExecutionRepository) GetStateByExecutionID(ctx context.Context, executionID uint) *State {
 	state := State{}
-	tx := r.db.WithContext(ctx).Where("execution_id = ?", executionID).Preload("Arguments").Preload("Outputs").First(&state)
+	tx := r.db.WithContext(ctx).Where("execution_id = ?", executionID).Preload("StepStates").Preload("Arguments").Preload("Outputs").First(&state)
 	if tx.Error != nil {
 		log.Printf("Failed to get state: %v", tx.Error)
 	}
@@ -80,7 +436,7 @@ func (r *ExecutionRepository) GetExecutionsByTags(ctx context.Context, tags []st
 	}
 	var outputExecutions []*Execution
 	for _, execution := range executions {
-		if execution.State.Status == PENDING || execution.State.Status == EXECUTING {
+		if !execution.State.IsFinished() {
 		tagsSearch:
 			for _, tag := range tags {
 				for _, executionTag := range execution.Tags {
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/docker/go-connections/nat"
 	_ "github.com/lib/pq"
@@ -53,7 +54,7 @@ func setupTestDB() (func(), *ExecutionRepository, error) {
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&Execution{}, &State{}, &Step{}, &KeyValueOutput{}, &KeyValueArgument{}, &KeyValueStep{}, &ExecutionParams{}, &Tags{})
+	err = db.AutoMigrate(&Execution{}, &State{}, &Step{}, &StepState{}, &StepRun{}, &StepDependency{}, &RetryPolicy{}, &KeyValueOutput{}, &KeyValueArgument{}, &KeyValueStep{}, &ExecutionParams{}, &Tags{}, &OutboxMessage{}, &ConcurrencyLease{}, &QueuedStep{})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -66,7 +67,7 @@ func setupTestDB() (func(), *ExecutionRepository, error) {
 	cleanup := func() {
 		err := postgresC.Terminate(ctx)
 		if err != nil {
-			fmt.Errorf("failed to terminate container: %v", err)
+			fmt.Printf("failed to terminate container: %v\n", err)
 		}
 	}
 
@@ -81,9 +82,9 @@ func GetGenericExecution() Execution {
 			{Tag: "automation"},
 		},
 		State: &State{
-			Step:    "Initialize",
-			Status:  PENDING,
-			Outputs: []*KeyValueOutput{},
+			Status:     PENDING,
+			StepStates: []*StepState{{Name: "Step 1", Status: PENDING}},
+			Outputs:    []*KeyValueOutput{},
 			Arguments: []*KeyValueArgument{
 				{Key: "param1", Value: "value1"},
 				{Key: "param2", Value: "value2"},
@@ -149,7 +150,7 @@ func TestExecutionRepository_CreateExecution(t *testing.T) {
 	assert.Equal(t, testExec.ID, uint(1))
 	assert.Equal(t, testExec.ExecutionUUID, "123e4567-e89b-12d3-a456-426614174000")
 	assert.Equal(t, testExec.State.ExecutionID, testExec.ID)
-	assert.Equal(t, testExec.State.Step, "Initialize")
+	assert.Equal(t, testExec.State.StepStates[0].StateID, testExec.State.ID)
 	assert.Equal(t, testExec.Steps[0].ExecutionID, testExec.ID)
 	assert.Equal(t, testExec.Params.DelayedSeconds, uint(10))
 	assert.Equal(t, testExec.Params.ExecutionID, testExec.ID)
@@ -258,3 +259,292 @@ func TestExecutionRepository_UpdateState(t *testing.T) {
 	assert.Equal(t, newExec.State.Status, EXECUTING)
 
 }
+
+func TestExecutionRepository_DeleteOutput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	testExec := GetGenericExecution()
+	testExec.State.Outputs = []*KeyValueOutput{{Key: "Step 1.msg", Value: NewJSONValue("hello")}, {Key: "error", Value: NewJSONValue(map[string]interface{}{"msg": "failed"})}}
+	repo.db.Create(&testExec)
+	repo.DeleteOutput(context.Background(), testExec.State.Outputs[1])
+	state := repo.GetStateByExecutionID(context.Background(), testExec.ID)
+
+	assert.Equal(t, len(state.Outputs), 1)
+	assert.Equal(t, state.Outputs[0].Key, "Step 1.msg")
+	assert.Equal(t, state.Outputs[0].Value.Decode(), "hello")
+}
+
+func TestExecutionRepository_JSONOutputs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	testExec := GetGenericExecution()
+	testExec.State.Outputs = []*KeyValueOutput{{Key: "Step 1.files", Value: NewJSONValue([]interface{}{"a.txt", map[string]interface{}{"size": 2}})}}
+	repo.db.Create(&testExec)
+	state := repo.GetStateByExecutionID(context.Background(), testExec.ID)
+
+	assert.DeepEqual(t, state.Outputs[0].Value.Decode(), []interface{}{"a.txt", map[string]interface{}{"size": float64(2)}})
+}
+
+func TestExecutionRepository_GetLatestStepRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	testExec := GetGenericExecution()
+	repo.db.Create(&testExec)
+	repo.SaveStepRun(context.Background(), &StepRun{ExecutionID: testExec.ID, StepName: "Step 1", Attempt: 1, Status: FAILED})
+	repo.SaveStepRun(context.Background(), &StepRun{ExecutionID: testExec.ID, StepName: "Step 1", Attempt: 2, Status: EXECUTING})
+	run := repo.GetLatestStepRun(context.Background(), testExec.ID, "Step 1")
+	if run == nil {
+		t.Fatalf("failed to get latest step run")
+	}
+	assert.Equal(t, run.Attempt, uint(2))
+	assert.Equal(t, len(repo.GetStepRuns(context.Background(), testExec.ID)), 2)
+	assert.Assert(t, repo.GetLatestStepRun(context.Background(), testExec.ID, "Step 2") == nil)
+}
+
+func TestExecutionRepository_ClaimStepDispatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	testExec := GetGenericExecution()
+	testExec.State.StepStates = []*StepState{{Name: "Step 1", Status: EXECUTING, DispatchID: "second"}}
+	repo.db.Create(&testExec)
+	stepStateID := testExec.State.StepStates[0].ID
+
+	assert.Assert(t, !repo.ClaimStepDispatch(context.Background(), stepStateID, "first"))
+	assert.Assert(t, repo.ClaimStepDispatch(context.Background(), stepStateID, "second"))
+	assert.Assert(t, !repo.ClaimStepDispatch(context.Background(), stepStateID, "second"))
+}
+
+func TestExecutionRepository_GetStatesWithDueRetries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	now := time.Now()
+	due := GetGenericExecution()
+	due.State.StepStates = []*StepState{{Name: "Step 1", Status: RETRYING, RetryAt: sql.NullTime{Time: now.Add(-time.Second), Valid: true}}}
+	repo.db.Create(&due)
+	later := GetGenericExecution()
+	later.ExecutionUUID = "123e4567-e89b-12d3-a456-426614174001"
+	later.State.StepStates = []*StepState{{Name: "Step 1", Status: RETRYING, RetryAt: sql.NullTime{Time: now.Add(time.Minute), Valid: true}}}
+	repo.db.Create(&later)
+	cancelled := GetGenericExecution()
+	cancelled.ExecutionUUID = "123e4567-e89b-12d3-a456-426614174002"
+	cancelled.State.Status = CANCELLED
+	cancelled.State.StepStates = []*StepState{{Name: "Step 1", Status: RETRYING, RetryAt: sql.NullTime{Time: now.Add(-time.Second), Valid: true}}}
+	repo.db.Create(&cancelled)
+
+	states := repo.GetStatesWithDueRetries(context.Background(), now)
+	assert.Equal(t, len(states), 1)
+	assert.Equal(t, states[0].ExecutionID, due.ID)
+}
+
+func TestExecutionRepository_GetStatesWithDueWakes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	now := time.Now()
+	due := GetGenericExecution()
+	due.State.StepStates = []*StepState{{Name: "Step 1", Status: WAITING, WakeAt: sql.NullTime{Time: now.Add(-time.Second), Valid: true}}}
+	repo.db.Create(&due)
+	// Waits for a signal without a timeout never wake up
+	signal := GetGenericExecution()
+	signal.ExecutionUUID = "123e4567-e89b-12d3-a456-426614174001"
+	signal.State.StepStates = []*StepState{{Name: "Step 1", Status: WAITING, Signal: "approved"}}
+	repo.db.Create(&signal)
+
+	states := repo.GetStatesWithDueWakes(context.Background(), now)
+	assert.Equal(t, len(states), 1)
+	assert.Equal(t, states[0].ExecutionID, due.ID)
+}
+
+func TestExecutionRepository_GetWorkflowLineage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	parent := GetGenericExecution()
+	parent.WorkflowID = 1
+	repo.db.Create(&parent)
+	child := GetGenericExecution()
+	child.ExecutionUUID = "123e4567-e89b-12d3-a456-426614174001"
+	child.WorkflowID = 2
+	child.ParentExecutionID = parent.ID
+	repo.db.Create(&child)
+
+	assert.DeepEqual(t, repo.GetWorkflowLineage(context.Background(), child.ID), []uint{2, 1})
+	// Children are not submissions of their workflow
+	assert.Assert(t, repo.GetLatestWorkflowExecution(context.Background(), 2) == nil)
+	assert.Equal(t, repo.GetLatestWorkflowExecution(context.Background(), 1).ID, parent.ID)
+}
+
+func TestExecutionRepository_PublishOutbox(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	ctx := context.Background()
+	for _, payload := range []string{"first", "second", "third"} {
+		assert.NilError(t, repo.AddOutboxMessage(ctx, &OutboxMessage{Payload: payload}))
+	}
+
+	// Publishing stops at the first failure and the failed message is kept
+	payloads := make([]string, 0)
+	published, err := repo.PublishOutbox(ctx, 10, func(message *OutboxMessage) error {
+		if message.Payload == "second" && len(payloads) == 1 {
+			return errors.New("broker unavailable")
+		}
+		payloads = append(payloads, message.Payload)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, published, 1)
+
+	published, err = repo.PublishOutbox(ctx, 10, func(message *OutboxMessage) error {
+		payloads = append(payloads, message.Payload)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, published, 2)
+	assert.DeepEqual(t, payloads, []string{"first", "second", "third"})
+}
+
+func TestExecutionRepository_UpdateStateConflict(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	ctx := context.Background()
+	testExec := GetGenericExecution()
+	repo.db.Create(&testExec)
+
+	cancelled := repo.GetStateByExecutionID(ctx, testExec.ID)
+	succeeded := repo.GetStateByExecutionID(ctx, testExec.ID)
+	cancelled.Status = CANCELLED
+	assert.NilError(t, repo.UpdateState(ctx, cancelled))
+	assert.Equal(t, cancelled.Version, uint(1))
+
+	// The late writer loaded the state before the cancellation and loses
+	succeeded.Status = SUCCESS
+	assert.ErrorIs(t, repo.UpdateState(ctx, succeeded), ErrConflict)
+	assert.Equal(t, repo.GetStateByExecutionID(ctx, testExec.ID).Status, CANCELLED)
+
+	// A transaction with a conflict fails even if the conflict is ignored
+	err = repo.Transaction(ctx, func(tx *ExecutionRepository) error {
+		tx.UpdateState(ctx, succeeded)
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestExecutionRepository_Concurrency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("failed to setup test db: %v", err)
+	}
+	defer cleanup()
+	ctx := context.Background()
+	limits := map[string]uint{"service:ubuntu_service": 2, "key:nightly": 1}
+
+	full, err := repo.AcquireConcurrency(ctx, 1, limits)
+	assert.NilError(t, err)
+	assert.Equal(t, full, "")
+	// Acquiring again keeps the same leases
+	full, err = repo.AcquireConcurrency(ctx, 1, limits)
+	assert.NilError(t, err)
+	assert.Equal(t, full, "")
+	full, err = repo.AcquireConcurrency(ctx, 2, limits)
+	assert.NilError(t, err)
+	assert.Equal(t, full, "key:nightly")
+
+	assert.NilError(t, repo.QueueStep(ctx, &QueuedStep{Key: full, ExecutionID: 2, StepName: "second"}))
+	assert.Assert(t, repo.PopQueuedStep(ctx, "service:ubuntu_service") == nil)
+
+	keys := repo.ReleaseConcurrency(ctx, 1)
+	assert.DeepEqual(t, keys, []string{"key:nightly", "service:ubuntu_service"})
+	queued := repo.PopQueuedStep(ctx, "key:nightly")
+	assert.Assert(t, queued != nil)
+	assert.Equal(t, queued.StepName, "second")
+	assert.Assert(t, repo.PopQueuedStep(ctx, "key:nightly") == nil)
+
+	full, err = repo.AcquireConcurrency(ctx, 2, limits)
+	assert.NilError(t, err)
+	assert.Equal(t, full, "")
+}
+
+func TestMigrateStepColumn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	cleanup, repo, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer cleanup()
+
+	// An execution of a previous version, running its second step
+	execution := GetGenericExecution()
+	execution.Steps[0].StepOrder = 0
+	execution.Steps[1].StepOrder = 1
+	execution.State.Status = EXECUTING
+	execution.State.StepStates = nil
+	repo.CreateExecution(context.Background(), &execution)
+	assert.NilError(t, repo.db.Exec("ALTER TABLE states ADD COLUMN step text").Error)
+	assert.NilError(t, repo.db.Exec("UPDATE states SET step = ? WHERE id = ?", "Step 2", execution.State.ID).Error)
+
+	assert.NilError(t, migrateStepColumn(repo.db))
+
+	assert.Equal(t, repo.db.Migrator().HasColumn(&State{}, "step"), false)
+	migrated := repo.GetExecutionById(context.Background(), execution.ID)
+	assert.Equal(t, migrated.State.GetStepState("Step 1").Status, SUCCESS)
+	assert.Equal(t, migrated.State.GetStepState("Step 2").Status, EXECUTING)
+	assert.Equal(t, migrated.GetStep("Step 2").DependsOn("Step 1"), true)
+	assert.Equal(t, len(migrated.GetStep("Step 1").Dependencies), 0)
+}
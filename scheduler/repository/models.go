@@ -2,23 +2,153 @@ package repository
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 )
 
 const (
 	PENDING   string = "PENDING"
 	EXECUTING string = "EXECUTING"
+	RETRYING  string = "RETRYING"
+	PAUSED    string = "PAUSED"
+	WAITING   string = "WAITING"
 	SUCCESS   string = "SUCCESS"
 	FAILED    string = "FAILED"
 	CANCELLED string = "CANCELLED"
+	// A step on a path that a branching step did not take, the steps that depend on it don't wait for it
+	SKIPPED string = "SKIPPED"
+	// An execution that exceeded its deadline, its cleanup steps still run
+	TIMED_OUT string = "TIMED_OUT"
+	// An execution that failed is compensating while the compensations of its succeeded steps run
+	COMPENSATING        string = "COMPENSATING"
+	COMPENSATED         string = "COMPENSATED"
+	COMPENSATION_FAILED string = "COMPENSATION_FAILED"
 )
 
+// Priorities of the executions, the steps of higher priorities are consumed first
+const (
+	HIGH_PRIORITY   string = "high"
+	NORMAL_PRIORITY string = "normal"
+	LOW_PRIORITY    string = "low"
+)
+
+// Priorities from the highest to the lowest
+var Priorities = []string{HIGH_PRIORITY, NORMAL_PRIORITY, LOW_PRIORITY}
+
+// Phases of the steps, the steps of the workflow have no phase
+const (
+	COMPENSATION string = "COMPENSATION"
+	ON_FAILURE   string = "ON_FAILURE"
+	FINALLY      string = "FINALLY"
+	// Template of the steps a foreach step runs once per item
+	ITEM string = "ITEM"
+)
+
+// CompensationStepName returns the name of the step that compensates the step with the given name
+func CompensationStepName(name string) string {
+	return name + ":compensate"
+}
+
+// TemplateStepName returns the name of the template of the items of the foreach step with the given name
+func TemplateStepName(foreach string) string {
+	return foreach + ":template"
+}
+
+// ItemStepName returns the name of the step that runs the item with the given index of a foreach step
+func ItemStepName(foreach string, index int) string {
+	return fmt.Sprintf("%s[%d]", foreach, index)
+}
+
+// ParseItemStepName returns the foreach step and the index of the item a step runs, ok is false for other steps
+func ParseItemStepName(name string) (foreach string, index int, ok bool) {
+	open := strings.LastIndex(name, "[")
+	if open <= 0 || !strings.HasSuffix(name, "]") {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(name[open+1 : len(name)-1])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return name[:open], index, true
+}
+
 type KeyValueOutput struct {
 	gorm.Model
 	Key     string
-	Value   string
+	Value   JSONValue `gorm:"type:jsonb"`
 	StateID uint
 }
+
+// JSONValue is a JSON document stored in a jsonb column, it keeps the type of the value it holds
+type JSONValue json.RawMessage
+
+// NewJSONValue encodes a value, values that can't be encoded are stored as their text
+func NewJSONValue(value interface{}) JSONValue {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		bytes, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return bytes
+}
+
+// Decode returns the value held by the document, nil if it is empty
+func (j JSONValue) Decode() interface{} {
+	var value interface{}
+	if json.Unmarshal(j, &value) != nil {
+		return nil
+	}
+	return value
+}
+
+// String returns the text of string values and the JSON of the rest of the values
+func (j JSONValue) String() string {
+	var str string
+	if len(j) > 0 && j[0] == '"' && json.Unmarshal(j, &str) == nil {
+		return str
+	}
+	return string(j)
+}
+
+func (j JSONValue) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return "null", nil
+	}
+	return string(j), nil
+}
+
+func (j *JSONValue) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append(JSONValue(nil), v...)
+	case string:
+		*j = JSONValue(v)
+	default:
+		return fmt.Errorf("can't scan %T into a JSON value", src)
+	}
+	return nil
+}
+
+func (j JSONValue) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+func (j *JSONValue) UnmarshalJSON(data []byte) error {
+	*j = append(JSONValue(nil), data...)
+	return nil
+}
+
 type KeyValueArgument struct {
 	gorm.Model
 	Key     string
@@ -33,18 +163,89 @@ type KeyValueStep struct {
 }
 type ExecutionParams struct {
 	gorm.Model
-	DelayedSeconds uint
-	CronDefinition sql.NullString
-	ExecutionID    uint
+	DelayedSeconds     uint
+	CronDefinition     sql.NullString
+	MaxDurationSeconds uint         // How long each run may take once it starts
+	Deadline           sql.NullTime // When every run has to be finished by
+	ExecutionID        uint
+}
+type StepDependency struct {
+	gorm.Model
+	StepID    uint
+	DependsOn string
+}
+
+// RetryPolicy defines how a failed step is retried, the delay between attempts grows exponentially
+type RetryPolicy struct {
+	gorm.Model
+	StepID              uint
+	MaxAttempts         uint
+	InitialDelaySeconds uint
+	Multiplier          float64
+	RetryableErrors     string // Comma separated error codes, empty retries every error
+}
+
+// ShouldRetry reports whether a step that failed on the given attempt with the given error code has to be retried
+func (r *RetryPolicy) ShouldRetry(attempt uint, code string) bool {
+	if attempt >= r.MaxAttempts {
+		return false
+	}
+	if r.RetryableErrors == "" {
+		return true
+	}
+	for _, retryable := range strings.Split(r.RetryableErrors, ",") {
+		if retryable == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the backoff before the attempt that follows the given one, it is at least one second
+func (r *RetryPolicy) Delay(attempt uint) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+	seconds := float64(r.InitialDelaySeconds) * math.Pow(multiplier, float64(attempt-1))
+	return time.Duration(math.Max(1, math.Ceil(seconds))) * time.Second
 }
+
 type Step struct {
 	gorm.Model
-	ExecutionID uint
-	Name        string
-	Service     string
-	Task        string
-	StepOrder   int // Order of the step in the workflow MUST BE DONE MANUALLY
-	Inputs      []*KeyValueStep
+	ExecutionID  uint
+	Name         string
+	Service      string
+	Task         string
+	StepOrder    int // Order of the step in the workflow MUST BE DONE MANUALLY
+	Inputs       []*KeyValueStep
+	Dependencies []*StepDependency
+	Retry        *RetryPolicy
+	// Seconds the step can be executing before it times out, 0 means no timeout
+	TimeoutSeconds uint
+	Phase          string
+	Compensates    string // Name of the step undone by a compensation step
+	Foreach        string // Name of the foreach step of an item template
+}
+
+// DependsOn reports whether the step has to wait for the step with the given name
+func (s *Step) DependsOn(name string) bool {
+	for _, d := range s.Dependencies {
+		if d.DependsOn == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetInput returns the input of the step with the given key as it was submitted, empty if it has none
+func (s *Step) GetInput(key string) string {
+	for _, i := range s.Inputs {
+		if i.Key == key {
+			return i.Value
+		}
+	}
+	return ""
 }
 
 func (s *Step) ToExecutionStepDTO() ExecutionStepDTO {
@@ -53,12 +254,13 @@ func (s *Step) ToExecutionStepDTO() ExecutionStepDTO {
 		inputs[i.Key] = i.Value
 	}
 	return ExecutionStepDTO{
-		Service:     s.Service,
-		Name:        s.Name,
-		Task:        s.Task,
-		Input:       inputs,
-		ExecutionID: s.ExecutionID,
-		StepOrder:   s.StepOrder,
+		Service:        s.Service,
+		Name:           s.Name,
+		Task:           s.Task,
+		Input:          inputs,
+		ExecutionID:    s.ExecutionID,
+		StepOrder:      s.StepOrder,
+		TimeoutSeconds: s.TimeoutSeconds,
 	}
 }
 func (s *State) ToResponseStateDTO() ExecutionStateResponseDTO {
@@ -66,21 +268,234 @@ func (s *State) ToResponseStateDTO() ExecutionStateResponseDTO {
 	for _, o := range s.Outputs {
 		outputs[o.Key] = o.Value
 	}
+	steps := make(map[string]string)
+	errors := make(map[string]JSONValue)
+	for _, st := range s.StepStates {
+		steps[st.Name] = st.Status
+		if len(st.Error) > 0 && st.Status != SUCCESS {
+			errors[st.Name] = st.Error
+		}
+	}
 	return ExecutionStateResponseDTO{
-		Step:    s.Step,
+		Step:    s.currentStep(),
+		Steps:   steps,
 		Status:  s.Status,
 		Outputs: outputs,
+		Errors:  errors,
+	}
+}
+
+// currentStep returns the active step that was dispatched last, or the last dispatched step once none is active
+func (s *State) currentStep() string {
+	var current *StepState
+	for _, st := range s.StepStates {
+		if current == nil || st.dispatchedAfter(current) {
+			current = st
+		}
+	}
+	if current == nil {
+		return ""
+	}
+	return current.Name
+}
+
+// dispatchedAfter reports whether the step comes after the other one as the current step, active steps come first
+func (s *StepState) dispatchedAfter(other *StepState) bool {
+	if s.IsActive() != other.IsActive() {
+		return s.IsActive()
+	}
+	if !s.DispatchedAt.Time.Equal(other.DispatchedAt.Time) {
+		return s.DispatchedAt.Time.After(other.DispatchedAt.Time)
 	}
+	return s.ID > other.ID
+}
+
+// StepState tracks the status of a single step of an execution, there is one for each step that was dispatched
+type StepState struct {
+	gorm.Model
+	StateID      uint
+	Name         string
+	Status       string
+	Attempt      uint
+	DispatchedAt sql.NullTime // When the step was last enqueued
+	RetryAt      sql.NullTime // When a retrying step is dispatched again
+	TimeoutAt    sql.NullTime // When an executing step times out
+	WakeAt       sql.NullTime // When a waiting step finishes, or its signal expires
+	Signal       string       // Name of the signal a waiting step expects
+	DispatchID   string       // Dispatch of an executing step, its response has to echo it to be handled
+	Error        JSONValue    `gorm:"type:jsonb"` // Error envelope of the last failure of the step
+}
+
+// StepError is the error envelope of a failed step. Workers report it as their error output,
+// the scheduler fills the worker when it is missing and the attempt
+type StepError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+	Worker    string      `json:"worker"`
+	Attempt   uint        `json:"attempt"`
+}
+
+// OutboxMessage is a Kafka message written in the same transaction as the state change that produced it,
+// the relay publishes it afterwards
+type OutboxMessage struct {
+	gorm.Model
+	Destination string // Service whose input topic receives the message, empty for the steps topic
+	Priority    string // Priority of the topic, empty for normal
+	Headers     string // Kafka headers as a JSON object
+	Payload     string
+}
+
+// ConcurrencyLease is held by an executing step for each of its concurrency keys, like the service it runs on.
+// A key has at most its limit of leases
+type ConcurrencyLease struct {
+	gorm.Model
+	Key         string `gorm:"index"`
+	StepStateID uint   `gorm:"index"`
+}
+
+// QueuedStep is a step held because one of its concurrency keys reached its limit,
+// it is enqueued again once a lease of the key is released
+type QueuedStep struct {
+	gorm.Model
+	Key         string `gorm:"index"`
+	ExecutionID uint   `gorm:"index"`
+	StepName    string
+	Priority    string
+	Message     string // Message of the step to enqueue again
+}
+
+// StepRun records a single dispatch of a step, with the inputs the service received and its raw response
+type StepRun struct {
+	gorm.Model
+	ExecutionID  uint
+	StepName     string
+	Attempt      uint
+	Inputs       string // Resolved inputs as JSON
+	Response     string // Raw response as JSON
+	Status       string
+	DispatchedAt sql.NullTime // Enqueued on the steps topic
+	StartedAt    sql.NullTime // Sent to the service
+	FinishedAt   sql.NullTime // Response received
+}
+
+func nullTimeToPointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (r *StepRun) ToStepRunResponseDTO() StepRunResponseDTO {
+	var inputs, response json.RawMessage
+	if r.Inputs != "" {
+		inputs = json.RawMessage(r.Inputs)
+	}
+	if r.Response != "" {
+		response = json.RawMessage(r.Response)
+	}
+	return StepRunResponseDTO{
+		Step:         r.StepName,
+		Attempt:      r.Attempt,
+		Status:       r.Status,
+		Inputs:       inputs,
+		Response:     response,
+		DispatchedAt: nullTimeToPointer(r.DispatchedAt),
+		StartedAt:    nullTimeToPointer(r.StartedAt),
+		FinishedAt:   nullTimeToPointer(r.FinishedAt),
+	}
+}
+
+// IsActive reports whether the step is waiting to be dispatched, executing, waiting for a retry or sleeping
+func (s *StepState) IsActive() bool {
+	return s.Status == PENDING || s.Status == EXECUTING || s.Status == RETRYING || s.Status == WAITING
 }
 
 type State struct {
 	gorm.Model
 	ExecutionID uint
-	Step        string
 	Status      string
-	Outputs     []*KeyValueOutput
-	Arguments   []*KeyValueArgument
+	Phase       string       // Phase of the steps that are running, empty while running the steps of the workflow
+	Outcome     string       // Status the execution ends with once the steps of its failure and finally phases run
+	Version     uint         `gorm:"not null;default:0"` // Increased by every update, updates of an outdated state conflict
+	DeadlineAt  sql.NullTime // When the execution times out, cleared once it did
+	Priority    string       `gorm:"not null;default:normal"` // Priority of the topics its steps go through
+	// Steps of the executions with the same concurrency key run at most the limit at a time, no limit if 0
+	ConcurrencyKey   string
+	ConcurrencyLimit uint
+	StepStates       []*StepState
+	Outputs          []*KeyValueOutput
+	Arguments        []*KeyValueArgument
+}
+
+// NewState creates the state of a new execution with the given steps, its root steps are pending
+func NewState(status string, steps []*Step, arguments map[string]string) *State {
+	stepStates := make([]*StepState, 0)
+	for _, s := range steps {
+		if s.Phase == "" && len(s.Dependencies) == 0 {
+			stepStates = append(stepStates, &StepState{
+				Name:    s.Name,
+				Status:  PENDING,
+				Attempt: 1,
+			})
+		}
+	}
+	keyValueArguments := make([]*KeyValueArgument, 0, len(arguments))
+	for k, v := range arguments {
+		keyValueArguments = append(keyValueArguments, &KeyValueArgument{
+			Key:   k,
+			Value: v,
+		})
+	}
+	return &State{
+		Status:     status,
+		StepStates: stepStates,
+		Outputs:    make([]*KeyValueOutput, 0),
+		Arguments:  keyValueArguments,
+	}
+}
+
+// IsActive reports whether the execution can still dispatch or receive steps
+func (s *State) IsActive() bool {
+	return s.Status == PENDING || s.Status == EXECUTING || s.Status == WAITING || s.Status == COMPENSATING
+}
+
+// IsFinished reports whether the execution reached a final status
+func (s *State) IsFinished() bool {
+	return s.Status == SUCCESS || s.Status == FAILED || s.Status == CANCELLED || s.Status == TIMED_OUT ||
+		s.Status == COMPENSATED || s.Status == COMPENSATION_FAILED
 }
+
+func (s *State) GetStepState(name string) *StepState {
+	for _, st := range s.StepStates {
+		if st.Name == name {
+			return st
+		}
+	}
+	return nil
+}
+
+// HasActiveSteps reports whether any of the dispatched steps did not finish yet
+func (s *State) HasActiveSteps() bool {
+	for _, st := range s.StepStates {
+		if st.IsActive() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasStepsWithStatus reports whether any of the dispatched steps is in the given status
+func (s *State) HasStepsWithStatus(status string) bool {
+	for _, st := range s.StepStates {
+		if st.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
 type Tags struct {
 	gorm.Model
 	ExecutionID uint
@@ -95,4 +510,143 @@ type Execution struct {
 	Steps         []*Step
 	Params        *ExecutionParams
 	JobID         string
+	// Execution and step that started this one as a subworkflow, 0 if it was submitted
+	ParentExecutionID uint
+	ParentStepName    string
+}
+
+// GetStep returns the step with the given name, the steps of the items of a foreach step are built from its template
+func (e *Execution) GetStep(name string) *Step {
+	for _, s := range e.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	foreach, _, ok := ParseItemStepName(name)
+	if !ok {
+		return nil
+	}
+	template := e.GetStep(TemplateStepName(foreach))
+	if template == nil {
+		return nil
+	}
+	item := *template
+	item.Name = name
+	return &item
+}
+
+// CloneSteps copies the definition of the steps, so they can be saved for another execution
+func CloneSteps(steps []*Step) []*Step {
+	clones := make([]*Step, len(steps))
+	for i, s := range steps {
+		clone := &Step{
+			Name:           s.Name,
+			Service:        s.Service,
+			Task:           s.Task,
+			StepOrder:      s.StepOrder,
+			TimeoutSeconds: s.TimeoutSeconds,
+			Phase:          s.Phase,
+			Compensates:    s.Compensates,
+			Foreach:        s.Foreach,
+		}
+		for _, input := range s.Inputs {
+			clone.Inputs = append(clone.Inputs, &KeyValueStep{Key: input.Key, Value: input.Value})
+		}
+		for _, dependency := range s.Dependencies {
+			clone.Dependencies = append(clone.Dependencies, &StepDependency{DependsOn: dependency.DependsOn})
+		}
+		if s.Retry != nil {
+			clone.Retry = &RetryPolicy{
+				MaxAttempts:         s.Retry.MaxAttempts,
+				InitialDelaySeconds: s.Retry.InitialDelaySeconds,
+				Multiplier:          s.Retry.Multiplier,
+				RetryableErrors:     s.Retry.RetryableErrors,
+			}
+		}
+		clones[i] = clone
+	}
+	return clones
+}
+
+// StartDeadline sets when the execution times out, given that it starts now. It is the earliest of the deadline
+// and the end of the maximum duration of its parameters, executions without either never time out
+func (e *Execution) StartDeadline(now time.Time) {
+	if e.Params == nil || e.State == nil {
+		return
+	}
+	deadline := e.Params.Deadline
+	if e.Params.MaxDurationSeconds > 0 {
+		end := now.Add(time.Duration(e.Params.MaxDurationSeconds) * time.Second)
+		if !deadline.Valid || end.Before(deadline.Time) {
+			deadline = sql.NullTime{Time: end, Valid: true}
+		}
+	}
+	e.State.DeadlineAt = deadline
+}
+
+// RootSteps returns the steps that have no dependencies, they are the first ones to be dispatched
+func (e *Execution) RootSteps() []*Step {
+	return e.PhaseRootSteps("")
+}
+
+// PhaseRootSteps returns the steps of the given phase that have no dependencies
+func (e *Execution) PhaseRootSteps(phase string) []*Step {
+	roots := make([]*Step, 0)
+	for _, s := range e.Steps {
+		if s.Phase == phase && len(s.Dependencies) == 0 {
+			roots = append(roots, s)
+		}
+	}
+	return roots
+}
+
+// ReadySteps returns the steps that depend on the completed step and have all of their dependencies succeeded or skipped.
+// Steps that are already pending or executing are not returned, so a join step is only dispatched once,
+// neither are skipped steps
+func (e *Execution) ReadySteps(completed string) []*Step {
+	ready := make([]*Step, 0)
+	for _, s := range e.Steps {
+		if !s.DependsOn(completed) {
+			continue
+		}
+		if current := e.State.GetStepState(s.Name); current != nil && (current.IsActive() || current.Status == SKIPPED) {
+			continue
+		}
+		if e.DependenciesDone(s) {
+			ready = append(ready, s)
+		}
+	}
+	return ready
+}
+
+// DependenciesDone reports whether every dependency of the step succeeded or was skipped
+func (e *Execution) DependenciesDone(step *Step) bool {
+	for _, d := range step.Dependencies {
+		dependency := e.State.GetStepState(d.DependsOn)
+		if dependency == nil || (dependency.Status != SUCCESS && dependency.Status != SKIPPED) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextCompensation returns the compensation to run next, or nil if there is none left.
+// Compensations run one at a time, in the reverse order in which the steps they undo succeeded
+func (e *Execution) NextCompensation() *Step {
+	var next *Step
+	var nextCompensated *StepState
+	for _, s := range e.Steps {
+		if s.Phase != COMPENSATION || e.State.GetStepState(s.Name) != nil {
+			continue
+		}
+		compensated := e.State.GetStepState(s.Compensates)
+		if compensated == nil || compensated.Status != SUCCESS {
+			continue
+		}
+		if nextCompensated == nil || compensated.UpdatedAt.After(nextCompensated.UpdatedAt) {
+			next = s
+			nextCompensated = compensated
+		}
+	}
+	return next
 }
@@ -0,0 +1,431 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func getDiamondExecution(stepStates []*StepState) *Execution {
+	return &Execution{
+		State: &State{Status: EXECUTING, StepStates: stepStates},
+		Steps: []*Step{
+			{Name: "start"},
+			{Name: "left", Dependencies: []*StepDependency{{DependsOn: "start"}}},
+			{Name: "right", Dependencies: []*StepDependency{{DependsOn: "start"}}},
+			{Name: "join", Dependencies: []*StepDependency{{DependsOn: "left"}, {DependsOn: "right"}}},
+		},
+	}
+}
+
+func stepNames(steps []*Step) []string {
+	names := make([]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func TestExecution_ReadySteps(t *testing.T) {
+	tests := []struct {
+		name       string
+		stepStates []*StepState
+		completed  string
+		want       []string
+	}{
+		{
+			name:       "Fan out",
+			stepStates: []*StepState{{Name: "start", Status: SUCCESS}},
+			completed:  "start",
+			want:       []string{"left", "right"},
+		},
+		{
+			name: "Join waits for every parent",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS},
+				{Name: "left", Status: SUCCESS},
+				{Name: "right", Status: EXECUTING},
+			},
+			completed: "left",
+			want:      []string{},
+		},
+		{
+			name: "Join after every parent",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS},
+				{Name: "left", Status: SUCCESS},
+				{Name: "right", Status: SUCCESS},
+			},
+			completed: "right",
+			want:      []string{"join"},
+		},
+		{
+			name: "Join already dispatched",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS},
+				{Name: "left", Status: SUCCESS},
+				{Name: "right", Status: SUCCESS},
+				{Name: "join", Status: PENDING},
+			},
+			completed: "right",
+			want:      []string{},
+		},
+		{
+			name: "Join after a skipped parent",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS},
+				{Name: "left", Status: SUCCESS},
+				{Name: "right", Status: SKIPPED},
+			},
+			completed: "left",
+			want:      []string{"join"},
+		},
+		{
+			name: "Skipped step",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS},
+				{Name: "left", Status: SKIPPED},
+			},
+			completed: "start",
+			want:      []string{"right"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stepNames(getDiamondExecution(tt.stepStates).ReadySteps(tt.completed))
+			if len(got) != len(tt.want) {
+				t.Fatalf("ReadySteps() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ReadySteps() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExecution_RootSteps(t *testing.T) {
+	got := stepNames(getDiamondExecution(nil).RootSteps())
+	if len(got) != 1 || got[0] != "start" {
+		t.Errorf("RootSteps() = %v, want [start]", got)
+	}
+}
+
+func TestExecution_NextCompensation(t *testing.T) {
+	now := time.Now()
+	execution := &Execution{
+		Steps: []*Step{
+			{Name: "first"},
+			{Name: "second"},
+			{Name: "third"},
+			{Name: "first:compensate", Phase: COMPENSATION, Compensates: "first"},
+			{Name: "second:compensate", Phase: COMPENSATION, Compensates: "second"},
+			{Name: "third:compensate", Phase: COMPENSATION, Compensates: "third"},
+		},
+	}
+	stepState := func(name string, status string, updatedAt time.Time) *StepState {
+		st := &StepState{Name: name, Status: status}
+		st.UpdatedAt = updatedAt
+		return st
+	}
+	tests := []struct {
+		name       string
+		stepStates []*StepState
+		want       string
+	}{
+		{
+			name: "Last succeeded step first",
+			stepStates: []*StepState{
+				stepState("first", SUCCESS, now),
+				stepState("second", SUCCESS, now.Add(time.Second)),
+				stepState("third", FAILED, now.Add(2*time.Second)),
+			},
+			want: "second:compensate",
+		},
+		{
+			name: "Skips compensations already run",
+			stepStates: []*StepState{
+				stepState("first", SUCCESS, now),
+				stepState("second", SUCCESS, now.Add(time.Second)),
+				stepState("third", FAILED, now.Add(2*time.Second)),
+				stepState("second:compensate", SUCCESS, now.Add(3*time.Second)),
+			},
+			want: "first:compensate",
+		},
+		{
+			name:       "Nothing to compensate",
+			stepStates: []*StepState{stepState("first", FAILED, now)},
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execution.State = &State{Status: FAILED, StepStates: tt.stepStates}
+			got := ""
+			if next := execution.NextCompensation(); next != nil {
+				got = next.Name
+			}
+			if got != tt.want {
+				t.Errorf("NextCompensation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if roots := stepNames(execution.RootSteps()); len(roots) != 3 {
+		t.Errorf("RootSteps() = %v, want the workflow steps only", roots)
+	}
+}
+
+func TestRetryPolicy_ShouldRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt uint
+		code    string
+		want    bool
+	}{
+		{name: "Attempts left", policy: RetryPolicy{MaxAttempts: 3}, attempt: 2, want: true},
+		{name: "No attempts left", policy: RetryPolicy{MaxAttempts: 3}, attempt: 3, want: false},
+		{name: "Retryable code", policy: RetryPolicy{MaxAttempts: 3, RetryableErrors: "network,timeout"}, attempt: 1, code: "timeout", want: true},
+		{name: "Not retryable code", policy: RetryPolicy{MaxAttempts: 3, RetryableErrors: "network,timeout"}, attempt: 1, code: "invalid", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ShouldRetry(tt.attempt, tt.code); got != tt.want {
+				t.Errorf("ShouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialDelaySeconds: 2, Multiplier: 1.5}
+	want := []time.Duration{2 * time.Second, 3 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := policy.Delay(uint(i + 1)); got != w {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	noDelay := RetryPolicy{MaxAttempts: 2}
+	if got := noDelay.Delay(1); got != time.Second {
+		t.Errorf("Delay(1) = %v, want %v", got, time.Second)
+	}
+}
+
+func TestStepRun_ToStepRunResponseDTO(t *testing.T) {
+	dispatchedAt := time.Date(2024, 11, 20, 10, 0, 0, 0, time.UTC)
+	run := StepRun{
+		StepName:     "download",
+		Attempt:      2,
+		Inputs:       `{"s3_key":"file.txt"}`,
+		Status:       EXECUTING,
+		DispatchedAt: sql.NullTime{Time: dispatchedAt, Valid: true},
+	}
+	dto := run.ToStepRunResponseDTO()
+	if dto.Step != "download" || dto.Attempt != 2 || dto.Status != EXECUTING {
+		t.Errorf("ToStepRunResponseDTO() = %v", dto)
+	}
+	if string(dto.Inputs) != `{"s3_key":"file.txt"}` {
+		t.Errorf("Inputs = %s, want the stored inputs", dto.Inputs)
+	}
+	if dto.Response != nil {
+		t.Errorf("Response = %s, want nil", dto.Response)
+	}
+	if dto.DispatchedAt == nil || !dto.DispatchedAt.Equal(dispatchedAt) {
+		t.Errorf("DispatchedAt = %v, want %v", dto.DispatchedAt, dispatchedAt)
+	}
+	if dto.FinishedAt != nil {
+		t.Errorf("FinishedAt = %v, want nil", dto.FinishedAt)
+	}
+}
+
+func TestParseItemStepName(t *testing.T) {
+	tests := []struct {
+		name        string
+		stepName    string
+		wantForeach string
+		wantIndex   int
+		wantOk      bool
+	}{
+		{name: "Item", stepName: ItemStepName("files", 3), wantForeach: "files", wantIndex: 3, wantOk: true},
+		{name: "Workflow step", stepName: "files", wantOk: false},
+		{name: "Not an index", stepName: "files[a]", wantOk: false},
+		{name: "No foreach", stepName: "[1]", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			foreach, index, ok := ParseItemStepName(tt.stepName)
+			if ok != tt.wantOk || foreach != tt.wantForeach || index != tt.wantIndex {
+				t.Errorf("ParseItemStepName() = %v, %v, %v, want %v, %v, %v", foreach, index, ok, tt.wantForeach, tt.wantIndex, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestExecution_GetStep_Item(t *testing.T) {
+	execution := &Execution{
+		Steps: []*Step{
+			{Name: "files", Service: "native", Task: "foreach"},
+			{Name: TemplateStepName("files"), Service: "s3_service", Task: "download", Phase: ITEM, Foreach: "files"},
+		},
+	}
+	item := execution.GetStep("files[2]")
+	if item == nil || item.Name != "files[2]" || item.Service != "s3_service" || item.Task != "download" {
+		t.Errorf("GetStep() = %v, want the template named files[2]", item)
+	}
+	if execution.Steps[1].Name != TemplateStepName("files") {
+		t.Errorf("GetStep() modified the template: %v", execution.Steps[1])
+	}
+	if got := execution.GetStep("other[0]"); got != nil {
+		t.Errorf("GetStep() = %v, want nil", got)
+	}
+}
+
+func TestCloneSteps(t *testing.T) {
+	step := &Step{
+		Name:         "process",
+		Service:      "ubuntu_service",
+		Task:         "bash",
+		Inputs:       []*KeyValueStep{{Key: "cmd", Value: "ls"}},
+		Dependencies: []*StepDependency{{DependsOn: "download"}},
+		Retry:        &RetryPolicy{MaxAttempts: 3},
+	}
+	step.ID = 10
+	step.ExecutionID = 4
+	step.Inputs[0].ID = 11
+	clones := CloneSteps([]*Step{step})
+	clone := clones[0]
+	if clone.ID != 0 || clone.ExecutionID != 0 || clone.Inputs[0].ID != 0 {
+		t.Errorf("CloneSteps() kept the IDs of the original: %v", clone)
+	}
+	if clone.Name != "process" || clone.GetInput("cmd") != "ls" || !clone.DependsOn("download") || clone.Retry.MaxAttempts != 3 {
+		t.Errorf("CloneSteps() = %v, want a copy of %v", clone, step)
+	}
+	if clone.Retry == step.Retry {
+		t.Errorf("CloneSteps() shares the retry policy with the original")
+	}
+}
+
+func TestNewState(t *testing.T) {
+	steps := []*Step{
+		{Name: "first"},
+		{Name: "second", Dependencies: []*StepDependency{{DependsOn: "first"}}},
+		{Name: "cleanup", Phase: FINALLY},
+	}
+	state := NewState(PENDING, steps, map[string]string{"bucket": "files"})
+	if state.Status != PENDING || len(state.StepStates) != 1 || state.StepStates[0].Name != "first" {
+		t.Errorf("NewState() step states = %v, want only first pending", state.StepStates)
+	}
+	if len(state.Arguments) != 1 || state.Arguments[0].Key != "bucket" || state.Arguments[0].Value != "files" {
+		t.Errorf("NewState() arguments = %v, want bucket", state.Arguments)
+	}
+}
+
+func TestState_ToResponseStateDTO_Step(t *testing.T) {
+	dispatched := func(minutes int) sql.NullTime {
+		return sql.NullTime{Time: time.Date(2024, 1, 1, 0, minutes, 0, 0, time.UTC), Valid: true}
+	}
+	tests := []struct {
+		name       string
+		stepStates []*StepState
+		want       string
+	}{
+		{name: "No steps", want: ""},
+		{
+			name: "Active step dispatched last",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS, DispatchedAt: dispatched(1)},
+				{Name: "left", Status: EXECUTING, DispatchedAt: dispatched(2)},
+				{Name: "right", Status: EXECUTING, DispatchedAt: dispatched(3)},
+			},
+			want: "right",
+		},
+		{
+			name: "Active step over a later finished one",
+			stepStates: []*StepState{
+				{Name: "left", Status: RETRYING, DispatchedAt: dispatched(2)},
+				{Name: "right", Status: SUCCESS, DispatchedAt: dispatched(3)},
+			},
+			want: "left",
+		},
+		{
+			name: "Last dispatched step once finished",
+			stepStates: []*StepState{
+				{Name: "start", Status: SUCCESS, DispatchedAt: dispatched(1)},
+				{Name: "join", Status: FAILED, DispatchedAt: dispatched(4)},
+			},
+			want: "join",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &State{Status: EXECUTING, StepStates: tt.stepStates}
+			if got := state.ToResponseStateDTO().Step; got != tt.want {
+				t.Errorf("ToResponseStateDTO().Step = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      interface{}
+		wantJSON   string
+		wantString string
+	}{
+		{name: "String", value: "/tmp/report.csv", wantJSON: `"/tmp/report.csv"`, wantString: "/tmp/report.csv"},
+		{name: "Number", value: 3, wantJSON: `3`, wantString: "3"},
+		{name: "List", value: []string{"a", "b"}, wantJSON: `["a","b"]`, wantString: `["a","b"]`},
+		{name: "Object", value: map[string]int{"rows": 2}, wantJSON: `{"rows":2}`, wantString: `{"rows":2}`},
+		{name: "Null", value: nil, wantJSON: `null`, wantString: "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := NewJSONValue(tt.value)
+			if string(value) != tt.wantJSON {
+				t.Errorf("NewJSONValue() = %s, want %s", value, tt.wantJSON)
+			}
+			if value.String() != tt.wantString {
+				t.Errorf("String() = %s, want %s", value.String(), tt.wantString)
+			}
+			var scanned JSONValue
+			if err := scanned.Scan([]byte(tt.wantJSON)); err != nil || string(scanned) != tt.wantJSON {
+				t.Errorf("Scan() = %s, %v, want %s", scanned, err, tt.wantJSON)
+			}
+			dto, err := json.Marshal(map[string]interface{}{"value": value})
+			if err != nil || string(dto) != `{"value":`+tt.wantJSON+`}` {
+				t.Errorf("MarshalJSON() = %s, %v, want the value as JSON", dto, err)
+			}
+		})
+	}
+}
+
+func TestExecution_StartDeadline(t *testing.T) {
+	now := time.Date(2024, 11, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		params *ExecutionParams
+		want   sql.NullTime
+	}{
+		{name: "No parameters", params: nil, want: sql.NullTime{}},
+		{name: "No deadline", params: &ExecutionParams{DelayedSeconds: 10}, want: sql.NullTime{}},
+		{name: "Max duration", params: &ExecutionParams{MaxDurationSeconds: 60}, want: sql.NullTime{Time: now.Add(time.Minute), Valid: true}},
+		{name: "Deadline", params: &ExecutionParams{Deadline: sql.NullTime{Time: now.Add(time.Hour), Valid: true}}, want: sql.NullTime{Time: now.Add(time.Hour), Valid: true}},
+		{
+			name:   "Earliest of both",
+			params: &ExecutionParams{MaxDurationSeconds: 7200, Deadline: sql.NullTime{Time: now.Add(time.Hour), Valid: true}},
+			want:   sql.NullTime{Time: now.Add(time.Hour), Valid: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			execution := &Execution{Params: tt.params, State: &State{}}
+			execution.StartDeadline(now)
+			if execution.State.DeadlineAt != tt.want {
+				t.Errorf("StartDeadline() = %v, want %v", execution.State.DeadlineAt, tt.want)
+			}
+		})
+	}
+}
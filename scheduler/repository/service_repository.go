@@ -12,6 +12,10 @@ type Service struct {
 	Name        string `json:"name"`
 	InputTopic  string `json:"inputTopic"`
 	OutputTopic string `json:"outputTopic"`
+	// Prioritized services consume an input topic per priority, the rest receive every step on their input topic
+	Prioritized bool `json:"prioritized"`
+	// Steps of the service that run at a time, no limit if 0
+	MaxConcurrency uint `json:"maxConcurrency"`
 }
 
 type ServiceRepository struct {
@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.opentelemetry.io/otel/propagation"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"priorityfetcher"
+	"priorityfetcher/shutdown"
 	"scheduler/broker"
 	"scheduler/jobs"
 	"scheduler/repository"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 
@@ -60,14 +71,14 @@ func initTracer() func(context.Context) error {
 		log.Printf("Could not set resources: %s", err)
 	}
 
-	otel.SetTracerProvider(
-		sdktrace.NewTracerProvider(
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter),
-			sdktrace.WithResource(resources),
-		),
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resources),
 	)
-	return exporter.Shutdown
+	otel.SetTracerProvider(tracerProvider)
+	// Flushes the spans of the batcher before shutting down the exporter
+	return tracerProvider.Shutdown
 }
 
 func initLogger() (context.Context, *setupLog.LoggerProvider) {
@@ -102,6 +113,25 @@ func initLogger() (context.Context, *setupLog.LoggerProvider) {
 	return ctx, lp
 }
 
+// watchdogInterval is how often the leader checks for timed out steps, configured with WATCHDOG_INTERVAL_SECONDS
+func watchdogInterval() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("WATCHDOG_INTERVAL_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// outboxInterval is how often the outbox is polled for messages left by other instances or failed publishes,
+// configured with OUTBOX_POLL_INTERVAL_MILLISECONDS
+func outboxInterval() time.Duration {
+	milliseconds, err := strconv.Atoi(os.Getenv("OUTBOX_POLL_INTERVAL_MILLISECONDS"))
+	if err != nil || milliseconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
 func main() {
 	otel.SetTextMapPropagator(propagation.TraceContext{})
 	ctx, lp := initLogger()
@@ -124,6 +154,8 @@ func main() {
 	}
 
 	init := otelslog.NewLogger("init")
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	// Initialize the repository and broker
 	executionRepository := repository.NewExecutionRepository(repository.Initialize())
@@ -133,11 +165,46 @@ func main() {
 		if service.Server == "" {
 			continue
 		}
-		serviceTopics = append(serviceTopics, service.OutputTopic, service.InputTopic)
+		serviceTopics = append(serviceTopics, service.OutputTopic)
+		for _, priority := range repository.Priorities {
+			if topic := broker.ServiceInputTopic(service, priority); !slices.Contains(serviceTopics, topic) {
+				serviceTopics = append(serviceTopics, topic)
+			}
+		}
 	}
 	jobsRepository := jobs.Initialize()
 	broker.Initialize(serviceTopics)
 
+	kafkaHost := []string{os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")}
+	executionStepsWriters := make(map[string]*kafka.Writer)
+	for _, priority := range repository.Priorities {
+		executionStepsWriters[priority] = broker.GetWriter(kafkaHost, broker.PriorityTopic(broker.GetStepKafkaTopic(), priority))
+	}
+
+	serviceWriters := make(map[string]map[string]*kafka.Writer)
+	for _, service := range serviceRepository.GetServices() {
+		fmt.Printf("Service: %v\n", service.Name)
+		if service.Server == "" {
+			log.Printf("Service %s has no server", service.Name)
+			continue
+		}
+		serviceWriters[service.Name] = make(map[string]*kafka.Writer)
+		for _, priority := range repository.Priorities {
+			serviceWriters[service.Name][priority] = broker.GetWriter([]string{service.Server}, broker.ServiceInputTopic(service, priority))
+		}
+	}
+	tp := otel.GetTracerProvider()
+	handler := broker.NewHandler(executionRepository, serviceRepository, executionStepsWriters, serviceWriters, tp, jobsRepository, broker.ProduceMessage)
+	jobsRepository.CreateIntervalJob(watchdogInterval(), context.Background(), func() {
+		handler.CheckTimeouts()
+	}, uuid.New().String())
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		handler.RunOutboxRelay(relayCtx, outboxInterval())
+		close(relayDone)
+	}()
+
 	r := gin.Default()
 	r.Use(otelgin.Middleware(serviceName))
 	r.GET("/ping", func(c *gin.Context) {
@@ -173,6 +240,154 @@ func main() {
 		}
 
 	})
+	r.GET("/executions/:uuid/steps", func(c *gin.Context) {
+		stringUUID := c.Param("uuid")
+		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
+		if execution.ID == 0 {
+			c.JSON(404, gin.H{
+				"error": "execution not found",
+			})
+			return
+		}
+		runs := executionRepository.GetStepRuns(c.Request.Context(), execution.ID)
+		output := make([]repository.StepRunResponseDTO, len(runs))
+		for i, run := range runs {
+			output[i] = run.ToStepRunResponseDTO()
+		}
+		c.JSON(200, output)
+	})
+	r.POST("/executions/:uuid/retry", func(c *gin.Context) {
+		stringUUID := c.Param("uuid")
+		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
+		if execution.ID == 0 {
+			c.JSON(404, gin.H{
+				"error": "execution not found",
+			})
+			return
+		}
+		var retryRequest repository.RetryExecutionDTO
+		if c.Request.ContentLength > 0 {
+			err := c.BindJSON(&retryRequest)
+			if err != nil {
+				c.JSON(400, gin.H{
+					"error": "Invalid request, error parsing arguments",
+				})
+				return
+			}
+		}
+		err := handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+			return tx.RetryExecution(c.Request.Context(), execution.ID, retryRequest.Arguments)
+		})
+		if errors.Is(err, broker.ErrExecutionNotFailed) {
+			c.JSON(409, gin.H{
+				"error": "execution is not failed",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "execution retried",
+		})
+	})
+	r.POST("/executions/:uuid/signals/:name", func(c *gin.Context) {
+		stringUUID := c.Param("uuid")
+		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
+		if execution.ID == 0 {
+			c.JSON(404, gin.H{
+				"error": "execution not found",
+			})
+			return
+		}
+		payload := make(map[string]interface{})
+		if c.Request.ContentLength > 0 {
+			err := c.BindJSON(&payload)
+			if err != nil {
+				c.JSON(400, gin.H{
+					"error": "Invalid request, payload must be a JSON object",
+				})
+				return
+			}
+		}
+		err := handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+			return tx.Signal(c.Request.Context(), execution.ID, c.Param("name"), payload)
+		})
+		if errors.Is(err, broker.ErrSignalNotAwaited) {
+			c.JSON(409, gin.H{
+				"error": "no step is waiting for the signal",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "signal sent",
+		})
+	})
+	r.POST("/executions/:uuid/pause", func(c *gin.Context) {
+		stringUUID := c.Param("uuid")
+		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
+		if execution.ID == 0 {
+			c.JSON(404, gin.H{
+				"error": "execution not found",
+			})
+			return
+		}
+		err := handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+			return tx.PauseExecution(c.Request.Context(), execution.ID)
+		})
+		if errors.Is(err, broker.ErrExecutionNotActive) {
+			c.JSON(409, gin.H{
+				"error": "execution is not running",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "execution paused",
+		})
+	})
+	r.POST("/executions/:uuid/resume", func(c *gin.Context) {
+		stringUUID := c.Param("uuid")
+		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
+		if execution.ID == 0 {
+			c.JSON(404, gin.H{
+				"error": "execution not found",
+			})
+			return
+		}
+		err := handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+			return tx.ResumeExecution(c.Request.Context(), execution.ID)
+		})
+		if errors.Is(err, broker.ErrExecutionNotPaused) {
+			c.JSON(409, gin.H{
+				"error": "execution is not paused",
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"message": "execution resumed",
+		})
+	})
 	r.POST("/cancel-execution/:uuid", func(c *gin.Context) {
 		stringUUID := c.Param("uuid")
 		execution := executionRepository.GetExecutionByUUID(c.Request.Context(), stringUUID)
@@ -188,13 +403,22 @@ func main() {
 			JobMessage = "Job cancelled"
 		}
 		log.Printf("%s, %s", stringUUID, JobMessage)
-		if execution.State.Status != repository.PENDING && execution.State.Status != repository.EXECUTING {
+		if execution.State.IsFinished() {
 			c.JSON(200, gin.H{
 				"error": "execution already finished",
 			})
 			return
 		}
-		executionRepository.CancelExecution(c, execution)
+		err = handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+			tx.CancelExecution(c.Request.Context(), execution.ID)
+			return nil
+		})
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
 		c.JSON(200, gin.H{
 			"message": "execution cancelled",
 		})
@@ -216,43 +440,31 @@ func main() {
 			return
 		}
 		for _, execution := range executions {
-			executionRepository.CancelExecution(c, execution)
+			handler.InTransaction(c.Request.Context(), func(tx *broker.Handler) error {
+				tx.CancelExecution(c.Request.Context(), execution.ID)
+				return nil
+			})
 		}
 		c.JSON(200, gin.H{
 			"message": fmt.Sprintf("cancelled %d executions", len(executions)),
 		})
 	})
 
-	kafkaHost := []string{os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")}
-	executionStepsWriter := broker.GetWriter(kafkaHost, broker.GetStepKafkaTopic())
-
-	serviceWriters := make(map[string]*kafka.Writer)
-	for _, service := range serviceRepository.GetServices() {
-		fmt.Printf("Service: %v\n", service.Name)
-		if service.Server == "" {
-			log.Printf("Service %s has no server", service.Name)
-			continue
-		}
-		serviceWriters[service.Name] = broker.GetWriter([]string{service.Server}, service.InputTopic)
+	consumers := sync.WaitGroup{}
+	consume := func(readers []*kafka.Reader, handle func([]byte, []kafka.Header)) {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			broker.ConsumeMessageWithHandler(stopCtx, readers, -1, priorityfetcher.PoolSize(), handle)
+		}()
 	}
-	tp := otel.GetTracerProvider()
-	handler := broker.NewHandler(executionRepository, serviceRepository, executionStepsWriter, serviceWriters, tp, jobsRepository, broker.ProduceMessage)
 
 	executionReader := broker.GetExecutionReader()
+	consume([]*kafka.Reader{executionReader}, handler.Transactional((*broker.Handler).HandleExecutionSubmission))
 
-	go broker.ConsumeMessageWithHandler(
-		executionReader,
-		-1,
-		handler.HandleExecutionSubmission,
-	)
-
-	stepReader := broker.GetStepReader()
+	stepReaders := broker.GetStepReaders()
+	consume(stepReaders, handler.Transactional((*broker.Handler).HandleExecutionStep))
 
-	go broker.ConsumeMessageWithHandler(
-		stepReader,
-		-1,
-		handler.HandleExecutionStep,
-	)
 	for _, service := range serviceRepository.GetServices() {
 		if service.Server == "" {
 			continue
@@ -260,15 +472,61 @@ func main() {
 		serviceReader := broker.GetReader([]string{service.Server}, service.OutputTopic, service.Name)
 
 		fmt.Printf("Listening for topic %s\n", service.OutputTopic)
-		go broker.ConsumeMessageWithHandler(
-			serviceReader,
-			-1,
-			handler.HandleServiceResponse,
-		)
+		consume([]*kafka.Reader{serviceReader}, handler.Transactional((*broker.Handler).HandleServiceResponse))
+	}
+
+	// Same address as gin's Run
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	server := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		init.Info("Starting scheduler")
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving: %v\n", err)
+			stop()
+		}
+	}()
+
+	<-stopCtx.Done()
+	init.Info("Shutting down scheduler")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdown.Timeout())
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %v\n", err)
+	}
+	// The consumers stopped fetching when the signal was received, they return once their messages are handled
+	if !shutdown.WaitFor(shutdownCtx, &consumers) {
+		log.Printf("Timed out waiting for the messages being handled\n")
 	}
-	init.Info("Starting scheduler")
-	err := r.Run()
+	err = jobsRepository.Shutdown()
 	if err != nil {
-		return
+		log.Printf("Error shutting down jobs: %v\n", err)
+	}
+	// Publishes what the handlers left in the outbox
+	stopRelay()
+	select {
+	case <-relayDone:
+	case <-shutdownCtx.Done():
+		log.Printf("Timed out publishing the outbox\n")
+	}
+	for _, writer := range executionStepsWriters {
+		err = writer.Close()
+		if err != nil {
+			log.Printf("Error closing writer: %v\n", err)
+		}
+	}
+	for _, writers := range serviceWriters {
+		for _, writer := range writers {
+			err = writer.Close()
+			if err != nil {
+				log.Printf("Error closing writer: %v\n", err)
+			}
+		}
 	}
+	init.Info("Scheduler stopped")
 }
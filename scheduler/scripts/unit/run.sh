@@ -2,6 +2,6 @@
 
 cd ../../
 
-#docker build . -t taskcomposer/scheduler-unit-test -f Dockerfile.unit
+#docker build .. -t taskcomposer/scheduler-unit-test -f Dockerfile.unit
 #docker run --rm taskcomposer/scheduler-unit-test
 go test -v ./...
\ No newline at end of file
@@ -14,6 +14,7 @@ require (
 	go.opentelemetry.io/otel/sdk v1.33.0
 	go.opentelemetry.io/otel/sdk/log v0.9.0
 	go.opentelemetry.io/otel/trace v1.34.0
+	priorityfetcher v0.0.0
 )
 
 require (
@@ -42,3 +43,5 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	go.opentelemetry.io/contrib/bridges/otelslog v0.8.0
 )
+
+replace priorityfetcher => ../priorityfetcher
@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"priorityfetcher"
+	"priorityfetcher/shutdown"
+	"sync"
+	"syscall"
 	"time"
 	"ubuntu-service/service"
 
@@ -33,33 +39,69 @@ import (
 
 type Response struct {
 	ExecutionId int                    `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	Outputs     map[string]interface{} `json:"outputs"`
+	DispatchId  string                 `json:"dispatchId"`
 }
 
 type TaskRequest struct {
 	ExecutionId int                    `json:"executionId"`
+	StepName    string                 `json:"stepName"`
 	TaskName    string                 `json:"taskName"`
 	Inputs      map[string]interface{} `json:"inputs"`
+	DispatchId  string                 `json:"dispatchId"` // Echoed in the response so the scheduler can drop duplicates
 }
 
-func (t *TaskRequest) ToError(msg string) Response {
+// TaskError is the error envelope the scheduler expects in the error output, it fills the attempt
+type TaskError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+	Worker    string      `json:"worker"`
+}
+
+func (t *TaskRequest) ToError(code string, msg string, retryable bool) Response {
 	return Response{
 		ExecutionId: t.ExecutionId,
+		StepName:    t.StepName,
+		DispatchId:  t.DispatchId,
 		Outputs: map[string]interface{}{
-			"error": map[string]string{
-				"msg": msg,
+			"error": TaskError{
+				Code:      code,
+				Message:   msg,
+				Retryable: retryable,
+				Worker:    serviceName,
 			},
 		},
 	}
 }
 
+// ToTaskError reports an error of a task, invalid inputs are not worth retrying
+func (t *TaskRequest) ToTaskError(err error) Response {
+	var invalidInput *service.InvalidInputError
+	if errors.As(err, &invalidInput) {
+		return t.ToError("invalid_input", err.Error(), false)
+	}
+	var interrupted *service.InterruptedError
+	if errors.As(err, &interrupted) {
+		return t.ToError("interrupted", err.Error(), true)
+	}
+	return t.ToError("execution_failed", err.Error(), true)
+}
+
 func (t *TaskRequest) ToResponse(output map[string]interface{}) Response {
 	return Response{
 		ExecutionId: t.ExecutionId,
+		StepName:    t.StepName,
 		Outputs:     output,
+		DispatchId:  t.DispatchId,
 	}
 }
 
+// interruptTimeout is how long the interrupted tasks have to send their response once the shutdown timeout is hit
+const interruptTimeout = 5 * time.Second
+
 var (
 	serviceName      = os.Getenv("SERVICE_NAME")
 	grpcCollectorURL = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT_GRPC")
@@ -119,15 +161,15 @@ func initTracer() func(context.Context) error {
 		log.Printf("Could not set resources: %s", err)
 	}
 
-	otel.SetTracerProvider(
-		sdktrace.NewTracerProvider(
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter),
-			sdktrace.WithResource(resources),
-		),
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resources),
 	)
+	otel.SetTracerProvider(tracerProvider)
 
-	return exporter.Shutdown
+	// Flushes the spans of the batcher before shutting down the exporter
+	return tracerProvider.Shutdown
 }
 
 func initLogger() (context.Context, *setupLog.LoggerProvider) {
@@ -170,10 +212,7 @@ func main() {
 	}()
 	logger := otelslog.NewLogger("ubuntu-service")
 
-	err := initTracer()
-	if err != nil {
-		logger.Error("Error initializing tracer", slog.Any("err", err))
-	}
+	cleanup := initTracer()
 
 	HostPort := os.Getenv("HOST_PORT")
 
@@ -186,12 +225,9 @@ func main() {
 	}
 
 	brokers := []string{os.Getenv("KAFKA_HOST") + ":" + os.Getenv("KAFKA_PORT")}
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:        brokers,
-		GroupID:        "native",
-		Topic:          os.Getenv("INPUT_TOPIC"),
-		CommitInterval: time.Second,
-	})
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	fetcher := priorityfetcher.New(stopCtx, brokers, "native", os.Getenv("INPUT_TOPIC"), priorityfetcher.PoolSize())
 
 	writer := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:  brokers,
@@ -200,9 +236,19 @@ func main() {
 	})
 
 	log.Print("Listening on topic: " + os.Getenv("INPUT_TOPIC"))
+	// Handlers of the tasks being run, bash processes included
+	handlers := sync.WaitGroup{}
+	// Cancelled when the tasks take longer than the shutdown timeout, their commands are killed
+	tasksCtx, cancelTasks := context.WithCancel(context.Background())
+	defer cancelTasks()
+	fetching := make(chan struct{})
 	go func() {
+		defer close(fetching)
 		for {
-			msg, err := reader.FetchMessage(context.Background())
+			msg, reader, err := fetcher.FetchMessage(stopCtx)
+			if stopCtx.Err() != nil {
+				return
+			}
 			if err != nil {
 				logger.Error("Error reading message:", slog.Any("err", err))
 			} else {
@@ -213,9 +259,13 @@ func main() {
 					logger.Error("Error unmarshaling message:", slog.Any("err", err))
 					span.RecordError(err)
 					span.End()
+					fetcher.Done()
 					continue
 				}
+				handlers.Add(1)
 				go func() {
+					defer handlers.Done()
+					defer fetcher.Done() // Make room for the next message
 					defer span.End()
 					defer func(reader *kafka.Reader, ctx context.Context, msg kafka.Message) {
 						err := reader.CommitMessages(ctx, msg)
@@ -229,10 +279,10 @@ func main() {
 					var kafkaResponse Response
 					switch request.TaskName {
 					case "bash":
-						res, err := service.RunShell(request.Inputs, span)
+						res, err := service.RunShell(tasksCtx, request.Inputs, span)
 						if err != nil {
 							span.RecordError(err)
-							kafkaResponse = request.ToError(err.Error())
+							kafkaResponse = request.ToTaskError(err)
 						} else {
 							kafkaResponse = request.ToResponse(map[string]interface{}{
 								"stdout": res.Stdout,
@@ -240,10 +290,10 @@ func main() {
 							})
 						}
 					case "eval":
-						res, err := service.Eval(request.Inputs, span)
+						res, err := service.Eval(tasksCtx, request.Inputs, span)
 						if err != nil {
 							span.RecordError(err)
-							kafkaResponse = request.ToError(err.Error())
+							kafkaResponse = request.ToTaskError(err)
 						} else {
 							kafkaResponse = request.ToResponse(map[string]interface{}{
 								"result": res,
@@ -251,7 +301,7 @@ func main() {
 						}
 					default:
 						span.RecordError(fmt.Errorf("unknown task name: %s", request.TaskName))
-						kafkaResponse = request.ToError("Invalid task")
+						kafkaResponse = request.ToError("invalid_task", "Invalid task", false)
 					}
 
 					finalMsg, err := json.Marshal(kafkaResponse)
@@ -277,8 +327,44 @@ func main() {
 		}
 	})
 
-	errServer := http.ListenAndServe(":8080", nil)
-	if errServer != nil {
-		log.Printf("Error binding to port %s", HostPort)
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		errServer := server.ListenAndServe()
+		if errServer != nil && !errors.Is(errServer, http.ErrServerClosed) {
+			log.Printf("Error binding to port %s", HostPort)
+			stop()
+		}
+	}()
+
+	<-stopCtx.Done()
+	logger.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdown.Timeout())
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("Error shutting down server", slog.Any("err", err))
+	}
+	<-fetching
+	if !shutdown.WaitFor(shutdownCtx, &handlers) {
+		logger.Warn("Timed out waiting for the tasks being handled, interrupting them")
+		cancelTasks()
+		// The interrupted tasks answer with a retryable error so the scheduler runs them again
+		interruptCtx, cancelInterrupt := context.WithTimeout(context.Background(), interruptTimeout)
+		defer cancelInterrupt()
+		if !shutdown.WaitFor(interruptCtx, &handlers) {
+			logger.Warn("Timed out waiting for the interrupted tasks")
+		}
+	}
+	err = fetcher.Close()
+	if err != nil {
+		logger.Error("Error closing readers", slog.Any("err", err))
+	}
+	err = writer.Close()
+	if err != nil {
+		logger.Error("Error closing writer", slog.Any("err", err))
+	}
+	err = cleanup(shutdownCtx)
+	if err != nil {
+		logger.Error("Error shutting down tracer", slog.Any("err", err))
 	}
 }
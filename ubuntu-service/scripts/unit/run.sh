@@ -1,6 +1,6 @@
 #!/bin/bash
 
-cd ../../
+cd ../../../
 
-docker build . -t taskcomposer/ubuntu-service-unit-test -f Dockerfile.unit
+docker build . -t taskcomposer/ubuntu-service-unit-test -f ubuntu-service/Dockerfile.unit
 docker run --rm taskcomposer/ubuntu-service-unit-test
\ No newline at end of file
@@ -1,11 +1,14 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -16,6 +19,37 @@ type ShellResponse struct {
 	Stderr string
 }
 
+// InvalidInputError is returned when the inputs of a task are missing or malformed, running it again won't help
+type InvalidInputError struct {
+	msg string
+}
+
+func (e *InvalidInputError) Error() string {
+	return e.msg
+}
+
+// InterruptedError is returned when a command is stopped before it finishes, like when the service shuts down,
+// running it again may succeed
+type InterruptedError struct {
+	msg string
+}
+
+func (e *InterruptedError) Error() string {
+	return e.msg
+}
+
+// command runs the script with bash, the processes it starts are killed along with it once the context is done
+func command(ctx context.Context, script string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "bash", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Output is not waited for long once killed, a process that escaped the group may still hold it
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
 func injectArguments(cmd string, inputs map[string]interface{}) (string, error) {
 	re := regexp.MustCompile("\\{\\{([a-zA-Z0-9]+)}}")
 	erroredArgs := make([]string, 0)
@@ -28,7 +62,7 @@ func injectArguments(cmd string, inputs map[string]interface{}) (string, error)
 		return match
 	})
 	if len(erroredArgs) > 0 {
-		return "", fmt.Errorf("following args were not found: %s", strings.Join(erroredArgs, ", "))
+		return "", &InvalidInputError{msg: fmt.Sprintf("following args were not found: %s", strings.Join(erroredArgs, ", "))}
 	}
 	return newStr, nil
 }
@@ -44,11 +78,11 @@ Runs an evaluation on an expression using bc command
 
 Responds "224", nil
 */
-func Eval(inputs map[string]interface{}, span trace.Span) (string, error) {
+func Eval(ctx context.Context, inputs map[string]interface{}, span trace.Span) (string, error) {
 	exp, exists := inputs["exp"]
 	if !exists {
 		span.RecordError(fmt.Errorf("exp field not found in inputs: %v", inputs))
-		return "", errors.New("exp field is required")
+		return "", &InvalidInputError{msg: "exp field is required"}
 	}
 	expression, err := injectArguments(exp.(string), inputs)
 	if err != nil {
@@ -56,9 +90,12 @@ func Eval(inputs map[string]interface{}, span trace.Span) (string, error) {
 		return "", err
 	}
 	span.SetAttributes(attribute.String("exp", expression))
-	out, err := exec.Command("bash", "-c", fmt.Sprintf("echo $((%s))", expression)).Output()
+	out, err := command(ctx, fmt.Sprintf("echo $((%s))", expression)).Output()
 	if err != nil {
 		span.RecordError(err)
+		if ctx.Err() != nil {
+			return "", &InterruptedError{msg: fmt.Sprintf("evaluation interrupted: %s", ctx.Err())}
+		}
 		return "", err
 	}
 	return strings.TrimRight(string(out), "\n"), nil
@@ -77,11 +114,11 @@ Runs bash
 		 For normal usage, the error command is only reserved for mid execution mistakes
 	     Any output from Stderr is not returned by error, instead from ShellResponse
 */
-func RunShell(inputs map[string]interface{}, span trace.Span) (ShellResponse, error) {
+func RunShell(ctx context.Context, inputs map[string]interface{}, span trace.Span) (ShellResponse, error) {
 	cmd, exists := inputs["cmd"]
 	if !exists {
 		span.RecordError(fmt.Errorf("cmd field not found in inputs: %v", inputs))
-		return ShellResponse{}, fmt.Errorf("the cmd field is required")
+		return ShellResponse{}, &InvalidInputError{msg: "the cmd field is required"}
 	}
 	finalCmd, err := injectArguments(cmd.(string), inputs)
 	if err != nil {
@@ -89,10 +126,13 @@ func RunShell(inputs map[string]interface{}, span trace.Span) (ShellResponse, er
 		return ShellResponse{}, err
 	}
 	span.SetAttributes(attribute.String("cmd", finalCmd))
-	out, err := exec.Command("bash", "-c", finalCmd).Output()
+	out, err := command(ctx, finalCmd).Output()
 	if err != nil {
 		span.RecordError(err)
 		fmt.Printf("Error executing command %s", err)
+		if ctx.Err() != nil {
+			return ShellResponse{}, &InterruptedError{msg: fmt.Sprintf("command interrupted: %s", ctx.Err())}
+		}
 		var exitError *exec.ExitError
 		switch {
 		case errors.As(err, &exitError):
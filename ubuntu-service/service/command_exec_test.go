@@ -8,6 +8,7 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	trace2 "go.opentelemetry.io/otel/trace"
 	"testing"
+	"time"
 )
 
 func createSpan() (context.Context, trace2.Span) {
@@ -18,12 +19,12 @@ func createSpan() (context.Context, trace2.Span) {
 }
 
 func TestUnknownCommand(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "aaaaa"
-	response, err := RunShell(inputs, span)
+	response, err := RunShell(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Unknown command shouldn't have failed")
 		return
@@ -32,12 +33,12 @@ func TestUnknownCommand(t *testing.T) {
 }
 
 //func TestListCommands(t *testing.T) {
-//	_, span := createSpan()
+//	ctx, span := createSpan()
 //	defer span.End()
 //	inputs := make(map[string]interface{})
 //	inputs["cmd"] = "compgen -c"
 //
-//	response, err := RunShell(inputs, span)
+//	response, err := RunShell(ctx, inputs, span)
 //	if err != nil {
 //		return
 //	}
@@ -45,23 +46,25 @@ func TestUnknownCommand(t *testing.T) {
 //}
 
 func TestEmpty(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 
 	inputs := make(map[string]interface{})
-	_, err := RunShell(inputs, span)
+	_, err := RunShell(ctx, inputs, span)
 	if err == nil {
 		t.Errorf("Empty command should have failed")
 	}
+	var invalidInput *InvalidInputError
+	assert.ErrorAs(t, err, &invalidInput)
 }
 
 func TestEcho(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "echo"
 
-	response, err := RunShell(inputs, span)
+	response, err := RunShell(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed")
 		return
@@ -70,12 +73,12 @@ func TestEcho(t *testing.T) {
 }
 
 func TestReplace(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "echo {{1}}"
 	inputs["1"] = "hello world"
-	response, err := RunShell(inputs, span)
+	response, err := RunShell(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed")
 		return
@@ -84,20 +87,20 @@ func TestReplace(t *testing.T) {
 }
 
 func TestMissingReplacement(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "echo {{1}}"
-	_, err := RunShell(inputs, span)
+	_, err := RunShell(ctx, inputs, span)
 	assert.NotNil(t, err)
 }
 
 func TestGcEvaluate(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "echo 1+2 | bc"
-	res, err := RunShell(inputs, span)
+	res, err := RunShell(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed")
 		return
@@ -106,11 +109,11 @@ func TestGcEvaluate(t *testing.T) {
 }
 
 func TestPipeUnknownCmd(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["cmd"] = "echo 1+2 | aaaa"
-	res, err := RunShell(inputs, span)
+	res, err := RunShell(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed")
 		return
@@ -119,11 +122,11 @@ func TestPipeUnknownCmd(t *testing.T) {
 }
 
 func TestGeneralExp(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["exp"] = "2*1"
-	res, err := Eval(inputs, span)
+	res, err := Eval(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed %s", err)
 		return
@@ -132,13 +135,13 @@ func TestGeneralExp(t *testing.T) {
 }
 
 func TestExpWithReplace(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["exp"] = "{{a}}*{{b}}"
 	inputs["a"] = "123"
 	inputs["b"] = "456"
-	res, err := Eval(inputs, span)
+	res, err := Eval(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed %s", err)
 	}
@@ -146,14 +149,29 @@ func TestExpWithReplace(t *testing.T) {
 }
 
 func TestExpWithReplace2(t *testing.T) {
-	_, span := createSpan()
+	ctx, span := createSpan()
 	defer span.End()
 	inputs := make(map[string]interface{})
 	inputs["exp"] = "{{a}} * 100"
 	inputs["a"] = "7"
-	res, err := Eval(inputs, span)
+	res, err := Eval(ctx, inputs, span)
 	if err != nil {
 		t.Errorf("Should not have failed %s", err)
 	}
 	assert.Equal(t, fmt.Sprintf("%d", 7*100), res)
 }
+
+func TestInterrupted(t *testing.T) {
+	_, span := createSpan()
+	defer span.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	inputs := make(map[string]interface{})
+	inputs["cmd"] = "sleep 5 | cat"
+	start := time.Now()
+	_, err := RunShell(ctx, inputs, span)
+	var interrupted *InterruptedError
+	assert.ErrorAs(t, err, &interrupted)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}